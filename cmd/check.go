@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/longxiucai/patrol-tools/pkg/check"
+	"github.com/longxiucai/patrol-tools/pkg/unittest"
+
+	"github.com/golang/glog"
+)
+
+// checkConfigCmd validates the config file. The static checks run first, the metrics
+// referenced by the rules are only checked through the datasources if the config is valid.
+// Errors of loading the config, creating the datasource clients and importing the rules are reported as problems.
+func checkConfigCmd(args []string) error {
+	content, err := ioutil.ReadFile(pql.CfgFile)
+	if err != nil {
+		return fmt.Errorf("Error reading YAML file: %v", err)
+	}
+	problems := (&check.Checker{}).Check(content)
+	if !check.HasError(problems) {
+		if err := loadPqlConfig(); err != nil {
+			problems = append(problems, check.Problem{Level: check.ERROR, Message: err.Error()})
+		} else {
+			problems = (&check.Checker{PromQL: &pql}).Check(content)
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", pql.CfgFile)
+		return nil
+	}
+	if err := check.WriteProblems(os.Stdout, problems); err != nil {
+		return err
+	}
+	if check.HasError(problems) {
+		glog.Errorf("%s: config check failed", pql.CfgFile)
+		glog.Flush()
+		os.Exit(1)
+	}
+	return nil
+}
+
+// testCmd runs the rule unit test files against the rules of the config file
+func testCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("test requires at least one test file")
+	}
+	failed := false
+	for _, file := range args {
+		fmt.Printf("Unit Testing: %s\n", file)
+		errs := unittest.RunFile(file, pql.CfgFile)
+		if len(errs) == 0 {
+			fmt.Println("  SUCCESS")
+			continue
+		}
+		failed = true
+		fmt.Println("  FAILED:")
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+	}
+	if failed {
+		glog.Flush()
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/longxiucai/patrol-tools/pkg/writer"
+
+	"github.com/golang/glog"
+)
+
+// metricsCmd lists the metric names with their help and type, optionally only the given metric
+func metricsCmd(args []string) error {
+	var metric string
+	if len(args) > 0 {
+		metric = args[0]
+	}
+	meta, err := pql.MetaQuery(metric)
+	if err != nil {
+		return err
+	}
+	return writer.WriteTable(&writer.MetaResult{Meta: meta}, pql.Output, pql.NoHeaders)
+}
+
+// seriesCmd lists the series matching a selector over --start/--end
+func seriesCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("series requires exactly one series selector, e.g. 'up{job=\"node\"}'")
+	}
+	series, warnings, err := pql.SeriesQuery(args[0])
+	if len(warnings) > 0 {
+		glog.Warningf("Warnings: %v\n", warnings)
+	}
+	if err != nil {
+		return err
+	}
+	return writer.WriteTable(writer.SeriesResult(series), pql.Output, pql.NoHeaders)
+}
+
+// labelsCmd lists the values of a label, optionally only for the series matching the selectors
+func labelsCmd(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("labels requires a label name, e.g. 'namespace'")
+	}
+	values, warnings, err := pql.LabelsQuery(args[0], args[1:])
+	if len(warnings) > 0 {
+		glog.Warningf("Warnings: %v\n", warnings)
+	}
+	if err != nil {
+		return err
+	}
+	return writer.WriteTable(&writer.LabelsResult{Label: args[0], Values: values}, pql.Output, pql.NoHeaders)
+}
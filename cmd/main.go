@@ -1,10 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -14,7 +14,10 @@ import (
 	"github.com/longxiucai/patrol-tools/pkg/clients"
 	"github.com/longxiucai/patrol-tools/pkg/common"
 	"github.com/longxiucai/patrol-tools/pkg/promql"
+	"github.com/longxiucai/patrol-tools/pkg/recover"
+	"github.com/longxiucai/patrol-tools/pkg/rules"
 	"github.com/longxiucai/patrol-tools/pkg/shell"
+	"github.com/longxiucai/patrol-tools/pkg/util/timeexpr"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/common/config"
@@ -32,6 +35,13 @@ var (
 	// timeStr is a placeholder for the inital "time" flag value. We parse it to a time.Time for use in our queries
 	timeStr        string
 	kubeconfigPath string
+	// yamlFile is the raw content of the config file
+	yamlFile []byte
+	// dryRun prints the recovery plan instead of executing it, planFile saves it
+	dryRun   bool
+	planFile string
+	// evictDelete deletes pods through the eviction API
+	evictDelete bool
 )
 var stringFlags = []struct {
 	// pflag.StringVar 更适合直接将标志的值与程序中的变量关联
@@ -41,11 +51,11 @@ var stringFlags = []struct {
 	value    string
 	desc     string
 }{
-	{"host", &pql.Host, "http://127.0.0.1:9090", "prometheus server url"},
-	{"step", &pql.Step, "1m", "results step duration (h,m,s e.g. 1m)"},
-	{"start", &pql.Start, "", "query range start duration (either as a lookback in h,m,s e.g. 1m, or as an ISO 8601 formatted date string). Required for range queries. Cannot be used with --output=excel"},
-	{"end", &pql.End, "now", "query range end (either 'now', or an ISO 8601 formatted date string)"},
-	{"time", &timeStr, "now", "time for instant queries (either 'now', or an ISO 8601 formatted date string)"},
+	{"host", &pql.Host, "", "prometheus server url, or k8s://<namespace>/<service>:<port> through the kube-apiserver services proxy. Discovered from the kube cluster if empty"},
+	{"step", &pql.Step, "", "results step duration (h,m,s e.g. 1m), defaults to auto: 1m or larger to stay under 11000 points"},
+	{"start", &pql.Start, "", "query range start, a time expression e.g. 2h, now-2h, yesterday 09:00, unix seconds, RFC3339 or 2006-01-02 15:04:05. Required for range queries. Cannot be used with --output=excel"},
+	{"end", &pql.End, "now", "query range end, a time expression like --start"},
+	{"time", &timeStr, "now", "time for instant queries, a time expression like --start"},
 	{"output", &pql.Output, "", "override the default output format (graph for range queries, table for instant queries and metric names). Options: json,csv,excel (Cannot be used with --start)"},
 	{"auth-type", &pql.Auth.Type, "", "optional auth scheme for http requests to prometheus e.g. \"Basic\" or \"Bearer\""},
 	{"auth-credentials", &pql.Auth.Credentials, "", "optional auth credentials string for http requests to prometheus"},
@@ -56,6 +66,10 @@ var stringFlags = []struct {
 	{"tls_config.servername", &pql.TLSConfig.ServerName, "", "server name for TLS config"},
 	{"output-path", &pql.OutputPath, ".", "save to result path"},
 	{"kubeconfig", &pql.KubeConfigPath, "~/.kube/config", "kubeconfig for delete pod"},
+	{"record", &pql.Record, "", "record every prometheus request and its raw response into the directory"},
+	{"replay", &pql.Replay, "", "replay the prometheus responses recorded into the directory instead of querying prometheus, recovery and --dry-run are skipped"},
+	{"plan-file", &planFile, "", "save the recovery plan of --dry-run to the file, executed later by the apply command"},
+	{"timezone", &pql.Timezone, "", "timezone of the time expressions and of the output timestamps, e.g. Asia/Shanghai (default local)"},
 }
 var boolFlags = []struct {
 	name     string
@@ -64,12 +78,39 @@ var boolFlags = []struct {
 	desc     string
 }{
 	{"no-headers", &pql.NoHeaders, false, "disable table headers for instant queries"},
+	{"dry-run", &dryRun, false, "print the recovery plan, the targets and the commands or API calls, without changing anything (not with --replay)"},
+	{"evict-delete", &evictDelete, false, "delete pods through the eviction API, respecting PodDisruptionBudgets"},
 	{"tls_config.insecure_skip_verify", &pql.TLSConfig.InsecureSkipVerify, false, "disable the TLS verification of server certificates"},
 }
 
+// subcommands, running without a subcommand patrols all rules
+var commands = []struct {
+	name  string
+	usage string
+	desc  string
+	run   func(args []string) error
+	// noInit commands load the config file themselves
+	noInit bool
+}{
+	{"metrics", "metrics [metric]", "list metric names with their help and type", metricsCmd, false},
+	{"series", "series <selector>", "list series matching the selector over --start/--end", seriesCmd, false},
+	{"labels", "labels <label> [selector...]", "list values of the label over --start/--end", labelsCmd, false},
+	{"check-config", "check-config", "validate the config file without patrolling", checkConfigCmd, true},
+	{"test", "test <test-file>...", "test the rules against the synthetic series of the test files", testCmd, true},
+	{"apply", "apply <plan-file>", "execute the recovery plan saved by --dry-run --plan-file", applyCmd, true},
+	{"approvals", "approvals", "list the recovery steps of the approval file or configmap", approvalsCmd, true},
+	{"approve", "approve <id>...|all", "approve the pending recovery steps, executed by the next run", approveCmd, true},
+	{"reject", "reject <id>...|all", "reject the pending recovery steps", rejectCmd, true},
+}
+
 func main() {
-	pqlConfigInit()
 	// PrintStructAsKV(pql)
+	if pflag.NArg() > 0 {
+		runCommand(pflag.Arg(0), pflag.Args()[1:])
+		return
+	}
+	pqlConfigInit()
+	defer pql.Close()
 	resultList, warnings, err := pql.Run()
 	if len(warnings) > 0 {
 		glog.Warningf("Warnings: %v\n", warnings)
@@ -78,11 +119,6 @@ func main() {
 		glog.Fatal(err)
 	}
 
-	// 读取配置文件
-	yamlFile, err := ioutil.ReadFile(pql.CfgFile)
-	if err != nil {
-		log.Fatalf("Error reading YAML file: %v", err)
-	}
 	// ssh相关配置 处理异常资源
 	var sshconfig common.SSHCONFIG
 	err = yaml.Unmarshal(yamlFile, &sshconfig)
@@ -99,26 +135,109 @@ func main() {
 	shellconfig.Exec(&sshconfig)
 	fmt.Println(shellconfig)
 	// 输出检查结果，写入磁盘
-	resultList.Write(pql.OutputPath, pql.Output, pql.NoHeaders)
+	resultList.Write(pql.OutputPath, pql.Output, pql.NoHeaders, pql.Now)
 	if err != nil {
 		glog.Fatalln(err)
 	}
 
+	// 回放时不处理异常资源，也不输出治愈计划：计划需要查询当前集群的pod，与录制时的集群不一致
+	if pql.Replayer != nil {
+		if viper.GetBool("dry-run") {
+			glog.Warningf("Replaying %s, --dry-run is ignored: the recovery plan needs the live cluster", pql.Replay)
+		}
+		glog.Infof("Replaying %s, recovery is skipped", pql.Replay)
+		return
+	}
+
 	// kube client 处理异常资源
-	cb, err := clients.NewBuilder(kubeconfigPath)
+	cb := pql.KubeBuilder
+	if cb == nil {
+		glog.Fatalf("creating clients error: kubeconfig %s is not available", kubeconfigPath)
+	}
+	client, config := cb.KubeClientOrDie("kcc-agent"), cb.GetBuilderConfig()
+
+	// 处理计划，protected、未被include选中或被exclude排除的pod，以及超出规则限制(max-targets、max-percent、cooldown、daily-budget)的操作被跳过
+	recoverCfg, err := loadRecoverConfig(yamlFile)
 	if err != nil {
-		glog.Errorf("creating clients error: %v", err)
+		glog.Fatal(err)
+	}
+	plan, err := resultList.Plan(client, &sshconfig, recoverCfg.Protected)
+	if err != nil {
+		glog.Fatal(err)
 	}
-	client := cb.KubeClientOrDie("kcc-agent")
+	if viper.GetBool("evict-delete") {
+		plan = plan.EvictDeletes()
+	}
+	limiter, err := recover.NewLimiter(recoverCfg.RecoverState, client, pql.Rules)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	plan = limiter.Apply(plan, client)
 
-	// 处理异常资源
-	err = resultList.RunRecover(client, &sshconfig)
+	// --dry-run 只输出异常资源的处理计划，不做任何修改
+	if viper.GetBool("dry-run") {
+		if err := plan.Write(os.Stdout, pql.Output); err != nil {
+			glog.Fatal(err)
+		}
+		if planFile := viper.GetString("plan-file"); planFile != "" {
+			if err := plan.Save(planFile); err != nil {
+				glog.Fatal(err)
+			}
+			glog.Infof("Recovery plan saved to %s, run '%s apply %s' to execute it", planFile, common.NAME, planFile)
+		}
+		return
+	}
+
+	// 处理异常资源，开启审批时只执行审批通过的操作
+	plan, err = recoverCfg.Approval.Approve(plan, client, os.Stdin, os.Stdout)
 	if err != nil {
 		glog.Fatal(err)
 	}
+	// 处理所有目标，单个目标失败不影响其他目标
+	plan.Execute(client, config, &sshconfig, limiter)
+	// verify开启时重新执行expr检查处理结果，仍然异常的目标执行escalate
+	verifyErr := verifyRecovery(&plan, resultList, client, config, &sshconfig, recoverCfg, limiter)
+	if err := limiter.Save(); err != nil {
+		glog.Error(err)
+	}
+	// 每个目标的处理结果及汇总写入输出目录，有失败的目标时退出码为2
+	if err := writeRecoverReport(plan); err != nil {
+		glog.Error(err)
+	}
+	exitIfFailed(plan.Summary.Err())
+	if verifyErr != nil {
+		glog.Fatal(verifyErr)
+	}
 
 }
 
+func runCommand(name string, args []string) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if !cmd.noInit {
+				pqlConfigInit()
+			}
+			defer pql.Close()
+			if err := cmd.run(args); err != nil {
+				exitIfFailed(err)
+				glog.Fatalln(err)
+			}
+			return
+		}
+	}
+	pflag.Usage()
+	glog.Fatalf("unknown command %s", name)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nCommands:\n", common.NAME)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", cmd.usage, cmd.desc)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	pflag.PrintDefaults()
+}
+
 func init() {
 	pflag.StringVar(&pql.CfgFile, "config", common.DEFAULTCONFIGFILE, "config file location")
 	for _, flagConfig := range stringFlags {
@@ -140,6 +259,7 @@ func init() {
 		glog.Fatalln(err)
 	}
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Usage = usage
 	pflag.Parse()
 	pflag.Lookup("logtostderr").Value.Set("true")
 	viperInit()
@@ -176,11 +296,19 @@ func PrintStructAsKV(s interface{}) {
 	}
 }
 
+// pqlConfigInit loads the config of pql, exiting on the first error
 func pqlConfigInit() {
+	if err := loadPqlConfig(); err != nil {
+		glog.Fatalln(err)
+	}
+}
+
+// loadPqlConfig loads the flags and the config file into pql, creates the datasource clients and imports the rules
+func loadPqlConfig() error {
 	// 载入配置文件
 	viper.Unmarshal(&pql)
 	if pql.Start != "" && pql.Output == "excel" {
-		glog.Fatalln("Error args,--start Cannot be used with --output=excel,Or check config file")
+		return errors.New("Error args,--start Cannot be used with --output=excel,Or check config file")
 	}
 
 	// 赋值CA相关
@@ -199,24 +327,91 @@ func pqlConfigInit() {
 	timeout = viper.GetInt("timeout")
 	pql.TimeoutDuration = time.Duration(int64(timeout)) * time.Second
 
+	// 时区，用于解析时间表达式以及输出的时间、文件名
+	loc, err := timeexpr.LoadLocation(viper.GetString("timezone"))
+	if err != nil {
+		return err
+	}
+	pql.Location = loc
+
 	// Parse the timeStr from our --time flag if it was provided
-	pql.Time = time.Now()
+	pql.Time = time.Now().In(loc)
 	now := pql.Time
 	timeStr = viper.GetString("time")
 	if timeStr != "now" {
-		t, err := time.Parse(time.RFC3339, timeStr)
+		t, err := timeexpr.Parse(timeStr, now)
 		if err != nil {
-			glog.Fatalln(err)
+			return err
 		}
 		pql.Time = t
 	}
 
-	// Create and set client interface
-	cl, err := promql.CreateClientWithAuth(pql.Host, pql.Auth, pql.TLSConfig)
+	// 录制prometheus的响应，或者回放录制的响应（使用录制时的时间）
+	if pql.Record != "" && pql.Replay != "" {
+		return errors.New("Error args,--record Cannot be used with --replay")
+	}
+	if pql.Replay != "" {
+		replayer, err := promql.NewReplayer(pql.Replay)
+		if err != nil {
+			return err
+		}
+		pql.Replayer = replayer
+		now = replayer.Manifest.Now.In(loc)
+		pql.Time = replayer.Manifest.Time.In(loc)
+	}
+	if pql.Record != "" {
+		recorder, err := promql.NewRecorder(pql.Record, now, pql.Time)
+		if err != nil {
+			return err
+		}
+		pql.Recorder = recorder
+	}
+	pql.Now = now
+
+	// 读取配置文件
+	yamlFile, err = ioutil.ReadFile(pql.CfgFile)
 	if err != nil {
-		glog.Fatalln(err)
+		return fmt.Errorf("Error reading YAML file: %v", err)
+	}
+	// datasources相关配置，未配置则使用host
+	var dsconfig promql.DatasourceConfig
+	if err := yaml.Unmarshal(yamlFile, &dsconfig); err != nil {
+		return fmt.Errorf("Error unmarshaling YAML: %v", err)
+	}
+	dsconfig.SetDirectory(filepath.Dir(pql.CfgFile))
+	pql.Datasources = dsconfig.Datasources
+	pql.HTTPConfig = dsconfig.HTTPConfig
+	// 主机清单，scrape数据源直接抓取主机上的exporter
+	var inventory common.SSHCONFIG
+	if err := yaml.Unmarshal(yamlFile, &inventory); err != nil {
+		return fmt.Errorf("Error unmarshaling YAML: %v", err)
+	}
+	pql.Hosts = inventory.Hosts
+
+	//kube client, 与异常资源处理共用，同时用于通过kube-apiserver访问prometheus
+	kubeconfigPath = viper.GetString("kubeconfig")
+	cb, err := clients.NewBuilder(kubeconfigPath)
+	if err != nil {
+		glog.Warningf("creating clients error: %v", err)
+	} else {
+		pql.KubeBuilder = cb
+	}
+
+	// 导入prometheus告警规则
+	var importconfig rules.ImportConfig
+	if err := yaml.Unmarshal(yamlFile, &importconfig); err != nil {
+		return fmt.Errorf("Error unmarshaling YAML: %v", err)
+	}
+	importedRules, err := importconfig.Load(pql.KubeBuilder)
+	if err != nil {
+		return err
+	}
+	pql.Rules = append(pql.Rules, importedRules...)
+
+	// Create and set client interface
+	if err := pql.InitDatasources(); err != nil {
+		return err
 	}
-	pql.Client = cl
 
 	// result
 	dirTime := fmt.Sprintf("%4d%02d%02d-%02d%02d", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute())
@@ -225,10 +420,8 @@ func pqlConfigInit() {
 	// mkdir result path
 	if pql.Output == "json" || pql.Output == "csv" || pql.Output == "excel" {
 		if err := os.MkdirAll(pql.OutputPath, 0755); err != nil {
-			glog.Fatalf("mkdir path error: %s", err)
+			return fmt.Errorf("mkdir path error: %s", err)
 		}
 	}
-
-	//kube client
-	kubeconfigPath = viper.GetString("kubeconfig")
+	return nil
 }
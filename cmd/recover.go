@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/longxiucai/patrol-tools/pkg/clients"
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/recover"
+	"github.com/longxiucai/patrol-tools/pkg/result"
+	"github.com/longxiucai/patrol-tools/pkg/rules"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// exitRecoverFailed is the exit code when some recovery steps failed, the other targets are still recovered
+const exitRecoverFailed = 2
+
+// recoverConfig is the protected pods, the approval and the limit state sections of the config file
+type recoverConfig struct {
+	Protected    *common.Selector       `yaml:"protected"`
+	Approval     recover.ApprovalConfig `yaml:"approval"`
+	RecoverState recover.StoreConfig    `yaml:"recover-state"`
+}
+
+// loadRecoverConfig returns the recovery config of the config file content
+func loadRecoverConfig(content []byte) (recoverConfig, error) {
+	var cfg recoverConfig
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return cfg, fmt.Errorf("Error unmarshaling YAML: %v", err)
+	}
+	return cfg, nil
+}
+
+// kubeBuilder returns the clients builder of the kubeconfig flag
+func kubeBuilder() (*clients.Builder, error) {
+	cb, err := clients.NewBuilder(viper.GetString("kubeconfig"))
+	if err != nil {
+		return nil, fmt.Errorf("creating clients error: %v", err)
+	}
+	return cb, nil
+}
+
+// kubeClient returns the kube client of the kubeconfig flag
+func kubeClient() (kubernetes.Interface, error) {
+	cb, err := kubeBuilder()
+	if err != nil {
+		return nil, err
+	}
+	return cb.KubeClientOrDie("kcc-agent"), nil
+}
+
+// configRules returns the rules of the config file content, with the imported rules
+func configRules(content []byte, cb *clients.Builder) ([]common.Rule, error) {
+	var cfg struct {
+		Rules              []common.Rule `yaml:"rules"`
+		rules.ImportConfig `yaml:",inline"`
+	}
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling YAML: %v", err)
+	}
+	imported, err := cfg.ImportConfig.Load(cb)
+	if err != nil {
+		return nil, err
+	}
+	return append(cfg.Rules, imported...), nil
+}
+
+// applyCmd executes a recovery plan saved by --dry-run --plan-file.
+// The targets are not resolved again, only the ssh credentials, the selection of the pods and the limits
+// come from the config file.
+func applyCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("apply requires the plan file")
+	}
+	plan, err := recover.LoadPlan(args[0])
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(pql.CfgFile)
+	if err != nil {
+		return fmt.Errorf("Error reading YAML file: %v", err)
+	}
+	var sshconfig common.SSHCONFIG
+	if err := yaml.Unmarshal(content, &sshconfig); err != nil {
+		return fmt.Errorf("Error unmarshaling YAML: %v", err)
+	}
+	cfg, err := loadRecoverConfig(content)
+	if err != nil {
+		return err
+	}
+	cb, err := kubeBuilder()
+	if err != nil {
+		return err
+	}
+	client, config := cb.KubeClientOrDie("kcc-agent"), cb.GetBuilderConfig()
+	ruleList, err := configRules(content, cb)
+	if err != nil {
+		return err
+	}
+	// the labels of the pods are not saved, the pods are selected again with the protected pods of the config file
+	plan = plan.Reselect(client, ruleList, cfg.Protected)
+	// the cooldowns and the budgets may have changed since the plan was saved
+	limiter, err := recover.NewLimiter(cfg.RecoverState, client, ruleList)
+	if err != nil {
+		return err
+	}
+	plan = limiter.Apply(plan, client)
+
+	glog.Infof("Applying the recovery plan %s created at %s", args[0], plan.Created.Format("2006-01-02 15:04:05"))
+	if err := plan.Write(os.Stdout, viper.GetString("output")); err != nil {
+		return err
+	}
+	summary := plan.Execute(client, config, &sshconfig, limiter)
+	if err := limiter.Save(); err != nil {
+		glog.Error(err)
+	}
+	return summary.Err()
+}
+
+// approvalStore returns the approval store of the config file
+func approvalStore() (recover.ApprovalStore, error) {
+	content, err := ioutil.ReadFile(pql.CfgFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading YAML file: %v", err)
+	}
+	recoverCfg, err := loadRecoverConfig(content)
+	if err != nil {
+		return nil, err
+	}
+	cfg := recoverCfg.Approval
+	var client kubernetes.Interface
+	if cfg.ConfigMap != "" {
+		if client, err = kubeClient(); err != nil {
+			return nil, err
+		}
+	}
+	store, err := cfg.Store(client)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("%s: approval.file or approval.configmap is required", pql.CfgFile)
+	}
+	return store, nil
+}
+
+// approvalsCmd lists the recovery steps of the approval store
+func approvalsCmd(args []string) error {
+	store, err := approvalStore()
+	if err != nil {
+		return err
+	}
+	approvals, err := store.Load()
+	if err != nil {
+		return err
+	}
+	return recover.WriteApprovals(os.Stdout, approvals)
+}
+
+func approveCmd(args []string) error {
+	return setApprovalStatus(recover.APPROVED, args)
+}
+
+func rejectCmd(args []string) error {
+	return setApprovalStatus(recover.REJECTED, args)
+}
+
+// setApprovalStatus sets the status of the recovery steps with the id prefixes, or of every pending step for all
+func setApprovalStatus(status string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("the ids of the recovery steps or all are required")
+	}
+	ids := args
+	if len(args) == 1 && args[0] == "all" {
+		ids = nil
+	}
+	store, err := approvalStore()
+	if err != nil {
+		return err
+	}
+	approvals, err := recover.SetStatus(store, status, ids)
+	if err != nil {
+		return err
+	}
+	return recover.WriteApprovals(os.Stdout, approvals)
+}
+
+// verifyRecovery re-evaluates the rules with verify after the recovery and executes the escalation
+// of the targets still failing, like the recovery it is limited by the rules and approved if the approval is enabled.
+// The escalation steps are added to the plan and counted in its summary.
+func verifyRecovery(plan *recover.Plan, resultList result.ResultList, client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG, cfg recoverConfig, limiter *recover.Limiter) error {
+	escalation, err := resultList.Verify(plan, pql.Evaluate, client, sshconfig, cfg.Protected)
+	if err != nil || len(escalation.Steps) == 0 {
+		return err
+	}
+	if viper.GetBool("evict-delete") {
+		escalation = escalation.EvictDeletes()
+	}
+	// the targets just recovered are exempt from their cooldown, the other limits still apply
+	escalation = limiter.Apply(escalation, client)
+	escalation, err = cfg.Approval.Approve(escalation, client, os.Stdin, os.Stdout)
+	if err != nil {
+		return err
+	}
+	escalation.Execute(client, config, sshconfig, limiter)
+	plan.Steps = append(plan.Steps, escalation.Steps...)
+	summary := plan.Summarize()
+	plan.Summary = &summary
+	return nil
+}
+
+// writeRecoverReport writes the executed plan with the status of every step and the summary into the output path
+func writeRecoverReport(plan recover.Plan) error {
+	if len(plan.Steps) == 0 {
+		return nil
+	}
+	if err := plan.Write(os.Stdout, pql.Output); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(pql.OutputPath, 0755); err != nil {
+		return fmt.Errorf("mkdir path error: %s", err)
+	}
+	file := filepath.Join(pql.OutputPath, common.RECOVERFILEPREFIX+fmt.Sprintf("-%02d-%02d-%02d", pql.Now.Hour(), pql.Now.Minute(), pql.Now.Second())+".json")
+	if err := plan.Save(file); err != nil {
+		return fmt.Errorf("error writing to file:%v", err)
+	}
+	glog.Infof("Recovery report written to: %s", file)
+	return nil
+}
+
+// exitIfFailed exits with exitRecoverFailed if the error is of failed recovery steps
+func exitIfFailed(err error) {
+	if errors.Is(err, recover.ErrStepsFailed) {
+		glog.Error(err)
+		glog.Flush()
+		os.Exit(exitRecoverFailed)
+	}
+}
@@ -0,0 +1,570 @@
+// check validates the patrol config file
+package check
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/clients"
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/promql"
+	"github.com/longxiucai/patrol-tools/pkg/recover"
+	"github.com/longxiucai/patrol-tools/pkg/rules"
+	"github.com/longxiucai/patrol-tools/pkg/shell"
+	"github.com/longxiucai/patrol-tools/pkg/util/timeexpr"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// problem levels
+const (
+	ERROR   = "error"
+	WARNING = "warning"
+)
+
+// seriesLookback is the time range in which referenced metrics must have series
+const seriesLookback = time.Hour
+
+// Problem is a mistake found in the config file
+type Problem struct {
+	Level   string
+	Path    string
+	Message string
+}
+
+// tlsFlags are the tls_config flags set in the config file
+type tlsFlags struct {
+	CAFile             string `yaml:"ca_cert_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"servername"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// fileConfig is every key of the config file, unknown keys are rejected
+type fileConfig struct {
+	Host                string                 `yaml:"host"`
+	Step                string                 `yaml:"step"`
+	Start               string                 `yaml:"start"`
+	End                 string                 `yaml:"end"`
+	Time                string                 `yaml:"time"`
+	Output              string                 `yaml:"output"`
+	OutputPath          string                 `yaml:"output-path"`
+	NoHeaders           bool                   `yaml:"no-headers"`
+	Timeout             int                    `yaml:"timeout"`
+	KubeConfig          string                 `yaml:"kubeconfig"`
+	Record              string                 `yaml:"record"`
+	Replay              string                 `yaml:"replay"`
+	Timezone            string                 `yaml:"timezone"`
+	DryRun              bool                   `yaml:"dry-run"`
+	PlanFile            string                 `yaml:"plan-file"`
+	EvictDelete         bool                   `yaml:"evict-delete"`
+	Protected           *common.Selector       `yaml:"protected"`
+	Approval            recover.ApprovalConfig `yaml:"approval"`
+	RecoverState        recover.StoreConfig    `yaml:"recover-state"`
+	AuthType            string                 `yaml:"auth-type"`
+	AuthCredentials     string                 `yaml:"auth-credentials"`
+	AuthCredentialsFile string                 `yaml:"auth-credentials-file"`
+	TLSConfig           tlsFlags               `yaml:"tls_config"`
+	HTTPConfig          *promql.HTTPConfig     `yaml:"http_config"`
+	Datasources         []promql.Datasource    `yaml:"datasources"`
+	Rules               []common.Rule          `yaml:"rules"`
+	ShellRules          []shell.SHELL          `yaml:"shell-rules"`
+	SSH                 common.SSH             `yaml:"ssh"`
+	Hosts               []common.Host          `yaml:"hosts"`
+	rules.ImportConfig  `yaml:",inline"`
+}
+
+// Checker validates the config file content.
+// If PromQL is set, the metrics referenced by the rules are checked through its datasources.
+type Checker struct {
+	PromQL   *promql.PromQL
+	problems []Problem
+}
+
+func (c *Checker) add(level, path, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Level:   level,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Check returns all problems found in the config file content
+func (c *Checker) Check(content []byte) []Problem {
+	c.problems = nil
+	var cfg fileConfig
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, e := range typeErr.Errors {
+				c.add(ERROR, "", "%s", e)
+			}
+		} else {
+			c.add(ERROR, "", "%v", err)
+		}
+		// continue with the keys that are known
+		cfg = fileConfig{}
+		if err := yaml.Unmarshal(content, &cfg); err != nil {
+			return c.problems
+		}
+	}
+
+	c.checkTimes(cfg)
+	c.checkDatasources(cfg)
+	c.checkRules(cfg.Rules, "rules")
+	imported := c.checkImportedRules(cfg)
+	c.checkShellRules(cfg)
+	c.checkApproval(cfg.Approval)
+	c.checkRecoverState(cfg, imported)
+	c.checkSelector(cfg.Protected, "protected")
+	return c.problems
+}
+
+// checkImportedRules checks the rules of the rule files and the PrometheusRule objects, merged with the overlay.
+// The PrometheusRule objects are only listed if the kube client of PromQL is available. The imported rules are returned.
+func (c *Checker) checkImportedRules(cfg fileConfig) []common.Rule {
+	importConfig := cfg.ImportConfig
+	var cb *clients.Builder
+	if c.PromQL != nil {
+		cb = c.PromQL.KubeBuilder
+	}
+	if cb == nil {
+		importConfig.PrometheusRules.Enable = false
+	}
+	imported, err := importConfig.Load(cb)
+	if err != nil {
+		c.add(ERROR, "imported-rules", "%v", err)
+		return nil
+	}
+	c.checkRules(imported, "imported-rules")
+	return imported
+}
+
+// checkTimes checks the timezone and the time expressions of time, start and end
+func (c *Checker) checkTimes(cfg fileConfig) {
+	loc, err := timeexpr.LoadLocation(cfg.Timezone)
+	if err != nil {
+		c.add(ERROR, "timezone", "%v", err)
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
+	for _, expr := range []struct{ path, value string }{
+		{"time", cfg.Time},
+		{"start", cfg.Start},
+		{"end", cfg.End},
+	} {
+		if expr.value == "" {
+			continue
+		}
+		if _, err := timeexpr.Parse(expr.value, now); err != nil {
+			c.add(ERROR, expr.path, "%v", err)
+		}
+	}
+	if cfg.Step != "" && cfg.Step != promql.AutoStep {
+		if _, err := time.ParseDuration(cfg.Step); err != nil {
+			c.add(ERROR, "step", "%v", err)
+		}
+	}
+}
+
+func (c *Checker) checkDatasources(cfg fileConfig) {
+	names := make(map[string]struct{})
+	for _, ds := range cfg.Datasources {
+		names[ds.Name] = struct{}{}
+	}
+	for i, ds := range cfg.Datasources {
+		path := fmt.Sprintf("datasources[%d].fallback", i)
+		if _, ok := names[ds.Fallback]; ds.Fallback != "" && !ok {
+			c.add(ERROR, path, "fallback datasource %s not found", ds.Fallback)
+		} else if ds.Fallback != "" && ds.Fallback == ds.Name {
+			c.add(ERROR, path, "datasource %s can not be its own fallback", ds.Name)
+		}
+	}
+
+	names = make(map[string]struct{})
+	for i, ds := range cfg.Datasources {
+		path := fmt.Sprintf("datasources[%d]", i)
+		if ds.Name == "" {
+			c.add(ERROR, path, "name is required")
+		}
+		if _, ok := names[ds.Name]; ok {
+			c.add(ERROR, path, "duplicate datasource %s", ds.Name)
+		}
+		names[ds.Name] = struct{}{}
+
+		switch ds.Type {
+		case "", promql.PrometheusDatasource:
+		case promql.FileDatasource:
+			if len(ds.Files) == 0 {
+				c.add(ERROR, path+".files", "files are required by the file datasource")
+			}
+		case promql.TSDBDatasource:
+			if ds.Path == "" {
+				c.add(ERROR, path+".path", "path is required by the tsdb datasource")
+			}
+		case promql.ScrapeDatasource:
+			if len(ds.Scrape.Targets) == 0 && len(ds.Scrape.Inventory) == 0 {
+				c.add(ERROR, path+".scrape", "targets or inventory are required by the scrape datasource")
+			}
+		default:
+			c.add(ERROR, path+".type", "unknown datasource type %q", ds.Type)
+		}
+	}
+}
+
+func (c *Checker) checkRules(ruleList []common.Rule, prefix string) {
+	names := make(map[string]struct{})
+	for i, rule := range ruleList {
+		path := fmt.Sprintf("%s[%d]", prefix, i)
+		if rule.Name == "" {
+			c.add(ERROR, path, "name is required")
+		} else {
+			path = fmt.Sprintf("%s(%s)", path, rule.Name)
+		}
+		if _, ok := names[rule.Name]; ok && rule.Name != "" {
+			c.add(WARNING, path, "duplicate rule name %s", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+
+		if rule.For != "" {
+			if _, err := model.ParseDuration(rule.For); err != nil {
+				c.add(ERROR, path+".for", "%v", err)
+			}
+		}
+		if rule.Step != "" && rule.Step != promql.AutoStep {
+			if _, err := time.ParseDuration(rule.Step); err != nil {
+				c.add(ERROR, path+".step", "%v", err)
+			}
+		}
+		c.checkRecover(rule.Recover, path+".recover")
+		if rule.Anomaly != nil {
+			if rule.For != "" {
+				c.add(ERROR, path+".anomaly", "anomaly can not be used with for")
+			}
+			c.checkAnomaly(*rule.Anomaly, path+".anomaly")
+		}
+		if rule.Forecast != nil {
+			if rule.For != "" || rule.Anomaly != nil {
+				c.add(ERROR, path+".forecast", "forecast can not be used with for or anomaly")
+			}
+			c.checkForecast(*rule.Forecast, path+".forecast")
+		}
+
+		expr, err := parser.ParseExpr(rule.Expr)
+		if err != nil {
+			c.add(ERROR, path+".expr", "%v", err)
+			continue
+		}
+		c.checkSeries(rule, expr, path+".expr")
+	}
+}
+
+func (c *Checker) checkAnomaly(a common.Anomaly, path string) {
+	switch {
+	case a.Range == "" && len(a.Offsets) == 0:
+		c.add(ERROR, path, "offsets or range is required")
+	case a.Range != "" && len(a.Offsets) > 0:
+		c.add(ERROR, path, "offsets can not be used with range")
+	case a.Method == promql.AnomalyZScore && len(a.Offsets) == 1:
+		c.add(WARNING, path+".offsets", "the standard deviation of a single offset is 0, every change is an outlier")
+	}
+	for i, offset := range a.Offsets {
+		if _, err := model.ParseDuration(offset); err != nil {
+			c.add(ERROR, fmt.Sprintf("%s.offsets[%d]", path, i), "%v", err)
+		}
+	}
+	if a.Range != "" {
+		if _, err := model.ParseDuration(a.Range); err != nil {
+			c.add(ERROR, path+".range", "%v", err)
+		}
+	}
+	switch a.Method {
+	case "", promql.AnomalyPercent, promql.AnomalyZScore:
+	default:
+		c.add(ERROR, path+".method", "unknown method %q, expected %s or %s", a.Method, promql.AnomalyPercent, promql.AnomalyZScore)
+	}
+	switch a.Direction {
+	case "", promql.DirectionBoth, promql.DirectionUp, promql.DirectionDown:
+	default:
+		c.add(ERROR, path+".direction", "unknown direction %q, expected %s, %s or %s", a.Direction, promql.DirectionBoth, promql.DirectionUp, promql.DirectionDown)
+	}
+	if a.Threshold <= 0 {
+		c.add(ERROR, path+".threshold", "threshold must be positive")
+	}
+}
+
+func (c *Checker) checkForecast(f common.Forecast, path string) {
+	if f.Range == "" {
+		c.add(ERROR, path+".range", "range is required")
+	} else if _, err := model.ParseDuration(f.Range); err != nil {
+		c.add(ERROR, path+".range", "%v", err)
+	}
+	if f.Within != "" {
+		if _, err := model.ParseDuration(f.Within); err != nil {
+			c.add(ERROR, path+".within", "%v", err)
+		}
+	}
+	switch f.Direction {
+	case "", promql.DirectionUp, promql.DirectionDown:
+	default:
+		c.add(ERROR, path+".direction", "unknown direction %q, expected %s or %s", f.Direction, promql.DirectionUp, promql.DirectionDown)
+	}
+}
+
+func (c *Checker) checkRecover(r common.Recover, path string) {
+	if r == (common.Recover{}) {
+		return
+	}
+	if _, ok := recover.BuiltinActions[r.RecoveryType]; !ok {
+		c.add(ERROR, path+".type", "unknown recovery type %q", r.RecoveryType)
+		return
+	}
+	switch {
+	case r.Action == "":
+		c.add(ERROR, path+".action", "action is required")
+	case r.RecoveryType == recover.EXECTYPE:
+		c.checkExecCommand(r.Action, path+".action")
+	case !recover.IsBuiltinAction(r.RecoveryType, r.Action):
+		c.add(WARNING, path+".action", "%q is not one of the builtin actions %v, it runs as a shell command", r.Action, recover.BuiltinActions[r.RecoveryType])
+	}
+	if !recover.IsBuiltinAction(r.RecoveryType, r.Action) {
+		if _, err := recover.ParseAction(r.Action); err != nil {
+			c.add(ERROR, path+".action", "%v", err)
+		}
+	}
+	if r.MaxTargets < 0 {
+		c.add(ERROR, path+".max-targets", "max-targets can not be negative")
+	}
+	if r.DailyBudget < 0 {
+		c.add(ERROR, path+".daily-budget", "daily-budget can not be negative")
+	}
+	switch {
+	case r.MaxPercent < 0 || r.MaxPercent > 100:
+		c.add(ERROR, path+".max-percent", "max-percent must be between 0 and 100")
+	case r.MaxPercent > 0 && r.RecoveryType != recover.PODTYPE:
+		c.add(WARNING, path+".max-percent", "max-percent only limits pods")
+	}
+	if r.Cooldown != "" {
+		if _, err := model.ParseDuration(r.Cooldown); err != nil {
+			c.add(ERROR, path+".cooldown", "%v", err)
+		}
+	}
+	for _, d := range []struct{ key, value string }{
+		{"timeout", r.Timeout},
+		{"evict-timeout", r.EvictTimeout},
+		{"grace-period", r.GracePeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if _, err := model.ParseDuration(d.value); err != nil {
+			c.add(ERROR, path+"."+d.key, "%v", err)
+		}
+	}
+	if (r.Include != nil || r.Exclude != nil) && r.RecoveryType == recover.SERVICETYPE {
+		c.add(WARNING, path, "include and exclude only select pods")
+	}
+	if r.Container != "" && r.RecoveryType != recover.EXECTYPE {
+		c.add(WARNING, path+".container", "container is only used by exec")
+	}
+	if _, err := filepath.Match(r.Container, ""); err != nil {
+		c.add(ERROR, path+".container", "%q: %v", r.Container, err)
+	}
+	c.checkSelector(r.Include, path+".include")
+	c.checkSelector(r.Exclude, path+".exclude")
+	c.checkVerify(r, path+".verify")
+}
+
+// checkVerify checks the delay and the escalate action of the verification
+func (c *Checker) checkVerify(r common.Recover, path string) {
+	v := r.Verify
+	if v == nil {
+		return
+	}
+	if v.Delay != "" {
+		if _, err := model.ParseDuration(v.Delay); err != nil {
+			c.add(ERROR, path+".delay", "%v", err)
+		}
+	}
+	switch {
+	case v.Escalate == "":
+	case v.Escalate == r.Action:
+		c.add(WARNING, path+".escalate", "escalate is the same action %q as the recovery", v.Escalate)
+	case r.RecoveryType == recover.EXECTYPE:
+		c.checkExecCommand(v.Escalate, path+".escalate")
+	case !recover.IsBuiltinAction(r.RecoveryType, v.Escalate):
+		c.add(WARNING, path+".escalate", "%q is not one of the builtin actions %v, it runs as a shell command", v.Escalate, recover.BuiltinActions[r.RecoveryType])
+	}
+	if v.Escalate != "" && !recover.IsBuiltinAction(r.RecoveryType, v.Escalate) {
+		if _, err := recover.ParseAction(v.Escalate); err != nil {
+			c.add(ERROR, path+".escalate", "%v", err)
+		}
+	}
+}
+
+// checkExecCommand rejects the builtin actions of the other types as the command of exec,
+// it would run in the container instead of deleting or restarting the pod
+func (c *Checker) checkExecCommand(command, path string) {
+	for _, recoveryType := range []string{recover.PODTYPE, recover.SERVICETYPE} {
+		if recover.IsBuiltinAction(recoveryType, command) {
+			c.add(ERROR, path, "%q is the builtin action of %s, every action of exec is a command run in the container", command, recoveryType)
+			return
+		}
+	}
+}
+
+// checkSelector checks the namespace patterns, the pod regexes and the label selector
+func (c *Checker) checkSelector(sel *common.Selector, path string) {
+	if sel == nil {
+		return
+	}
+	for i, pattern := range sel.Namespaces {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			c.add(ERROR, fmt.Sprintf("%s.namespaces[%d]", path, i), "%q: %v", pattern, err)
+		}
+	}
+	for i, pattern := range sel.Pods {
+		if _, err := regexp.Compile(pattern); err != nil {
+			c.add(ERROR, fmt.Sprintf("%s.pods[%d]", path, i), "%v", err)
+		}
+	}
+	if sel.Labels != "" {
+		if _, err := labels.Parse(sel.Labels); err != nil {
+			c.add(ERROR, path+".labels", "%v", err)
+		}
+	}
+}
+
+// checkRecoverState checks that the rules with cooldown or daily-budget, of the config file and imported,
+// have the state to check them against
+func (c *Checker) checkRecoverState(cfg fileConfig, imported []common.Rule) {
+	state := cfg.RecoverState
+	if state.File != "" && state.ConfigMap != "" {
+		c.add(ERROR, "recover-state", "file can not be used with configmap")
+	}
+	if parts := strings.SplitN(state.ConfigMap, "/", 2); state.ConfigMap != "" && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+		c.add(ERROR, "recover-state.configmap", "%q is not namespace/name", state.ConfigMap)
+	}
+	if state.File != "" || state.ConfigMap != "" {
+		return
+	}
+	for _, ruleList := range []struct {
+		prefix string
+		rules  []common.Rule
+	}{
+		{"rules", cfg.Rules},
+		{"imported-rules", imported},
+	} {
+		for i, rule := range ruleList.rules {
+			if rule.Recover.Cooldown != "" || rule.Recover.DailyBudget > 0 {
+				c.add(ERROR, fmt.Sprintf("%s[%d](%s).recover", ruleList.prefix, i, rule.Name), "cooldown and daily-budget require recover-state, the recovery of the rule is skipped")
+			}
+		}
+	}
+}
+
+// checkSeries checks that every metric selected by the expr has series in the datasources of the rule
+func (c *Checker) checkSeries(rule common.Rule, expr parser.Expr, path string) {
+	if c.PromQL == nil {
+		return
+	}
+	dsList, err := c.PromQL.GetDatasources(rule)
+	if err != nil {
+		c.add(ERROR, path, "%v", err)
+		return
+	}
+	var selectors []string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			// drop offset and @ modifiers
+			selector := &parser.VectorSelector{Name: vs.Name, LabelMatchers: vs.LabelMatchers}
+			selectors = append(selectors, selector.String())
+		}
+		return nil
+	})
+
+	end := c.PromQL.Time
+	start := end.Add(-seriesLookback)
+	for _, ds := range dsList {
+		for _, selector := range selectors {
+			ctx, cancel := context.WithTimeout(context.Background(), c.PromQL.TimeoutDuration)
+			series, _, err := ds.Client.Series(ctx, []string{selector}, start, end)
+			cancel()
+			if err != nil {
+				c.add(WARNING, path, "datasource %s: unable to check series of %s: %v", ds.Name, selector, err)
+				continue
+			}
+			if len(series) == 0 {
+				c.add(WARNING, path, "datasource %s: no series of %s in the last %s", ds.Name, selector, seriesLookback)
+			}
+		}
+	}
+}
+
+// checkShellRules checks that the node selector of every shell rule matches a role of the hosts
+func (c *Checker) checkShellRules(cfg fileConfig) {
+	roles := make(map[string]struct{})
+	for _, host := range cfg.Hosts {
+		for _, role := range host.Roles {
+			roles[role] = struct{}{}
+		}
+	}
+	for i, sh := range cfg.ShellRules {
+		path := fmt.Sprintf("shell-rules[%d](%s)", i, sh.Name)
+		for _, role := range sh.Selector {
+			if _, ok := roles[role]; !ok {
+				c.add(ERROR, path+".node-selector", "role %s does not exist in hosts", role)
+			}
+		}
+	}
+}
+
+func (c *Checker) checkApproval(a recover.ApprovalConfig) {
+	if !a.Enable {
+		return
+	}
+	if a.File != "" && a.ConfigMap != "" {
+		c.add(ERROR, "approval", "file can not be used with configmap")
+	}
+	if a.File == "" && a.ConfigMap == "" {
+		c.add(WARNING, "approval", "no file or configmap, the recovery is skipped in unattended runs")
+	}
+	if parts := strings.SplitN(a.ConfigMap, "/", 2); a.ConfigMap != "" && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+		c.add(ERROR, "approval.configmap", "%q is not namespace/name", a.ConfigMap)
+	}
+}
+
+// HasError returns true if any problem is an error
+func HasError(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Level == ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteProblems writes the problems as a tab separated table
+func WriteProblems(out io.Writer, problems []Problem) error {
+	const padding = 4
+	w := tabwriter.NewWriter(out, 0, 0, padding, ' ', 0)
+	if _, err := fmt.Fprintln(w, "LEVEL\tPATH\tMESSAGE"); err != nil {
+		return err
+	}
+	for _, p := range problems {
+		row := strings.Join([]string{strings.ToUpper(p.Level), p.Path, p.Message}, "\t")
+		if _, err := fmt.Fprintln(w, row); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,186 @@
+package check
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	ruleFile := filepath.Join(dir, "rules.yaml")
+	overlay := filepath.Join(dir, "overlay.yaml")
+	write := func(file, content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(ruleFile, `
+groups:
+- name: pods
+  rules:
+  - alert: PodFailed
+    expr: kube_pod_status_phase{phase="Failed"} > 0
+`)
+	write(overlay, `
+rules:
+- name: PodFailed
+  recover:
+    enable: true
+    type: pod
+    action: delete
+    cooldown: 30m
+`)
+	imports := "rule-files: [" + ruleFile + "]\nrules-overlay: " + overlay + "\n"
+
+	tests := []struct {
+		name   string
+		config string
+		// errors are the paths of the expected errors, nil for a valid config
+		errors []string
+	}{
+		{
+			name: "valid",
+			config: `
+rules:
+- name: up
+  expr: up == 0
+  recover:
+    enable: true
+    type: pod
+    action: delete
+    cooldown: 30m
+recover-state:
+  file: state.json
+protected:
+  namespaces: [kube-*]
+  labels: app=mysql
+`,
+		},
+		{
+			name:   "unknown key",
+			config: "hosst: http://localhost:9090\n",
+			errors: []string{""},
+		},
+		{
+			name: "bad expr",
+			config: `
+rules:
+- name: up
+  expr: up{job=
+`,
+			errors: []string{"rules[0](up).expr"},
+		},
+		{
+			name: "bad selector",
+			config: `
+protected:
+  namespaces: ["kube-["]
+  pods: ["web-("]
+  labels: "app in (mysql"
+`,
+			errors: []string{"protected.namespaces[0]", "protected.pods[0]", "protected.labels"},
+		},
+		{
+			name: "bad rule selector",
+			config: `
+rules:
+- name: up
+  expr: up == 0
+  recover:
+    type: pod
+    action: delete
+    include:
+      pods: ["web-("]
+`,
+			errors: []string{"rules[0](up).recover.include.pods[0]"},
+		},
+		{
+			name: "shell rule role",
+			config: `
+hosts:
+- ips: [192.168.1.1]
+  roles: [master]
+shell-rules:
+- name: disk
+  command: df
+  node-selector: [master, worker]
+`,
+			errors: []string{"shell-rules[0](disk).node-selector"},
+		},
+		{
+			name: "cooldown without recover-state",
+			config: `
+rules:
+- name: up
+  expr: up == 0
+  recover:
+    type: pod
+    action: delete
+    daily-budget: 3
+`,
+			errors: []string{"rules[0](up).recover"},
+		},
+		{
+			name: "exec builtin actions",
+			config: `
+rules:
+- name: oom
+  expr: container_memory_working_set_bytes > 0
+  recover:
+    type: exec
+    action: restart
+    evict-timeout: 1x
+    verify:
+      escalate: delete
+`,
+			errors: []string{"rules[0](oom).recover.action", "rules[0](oom).recover.evict-timeout", "rules[0](oom).recover.verify.escalate"},
+		},
+		{
+			name: "forecast direction",
+			config: `
+rules:
+- name: disk
+  expr: node_filesystem_avail_bytes
+  forecast:
+    range: 7d
+    limit: 0
+    direction: left
+`,
+			errors: []string{"rules[0](disk).forecast.direction"},
+		},
+		{
+			name:   "imported cooldown without recover-state",
+			config: imports,
+			errors: []string{"imported-rules[0](PodFailed).recover"},
+		},
+		{
+			name:   "imported cooldown with recover-state",
+			config: imports + "recover-state:\n  configmap: monitoring/patrol\n",
+		},
+		{
+			name:   "recover-state file and configmap",
+			config: "recover-state:\n  file: state.json\n  configmap: patrol\n",
+			errors: []string{"recover-state", "recover-state.configmap"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Checker
+			problems := c.Check([]byte(tt.config))
+			var errors []string
+			for _, p := range problems {
+				if p.Level == ERROR {
+					errors = append(errors, p.Path)
+				}
+			}
+			if strings.Join(errors, ",") != strings.Join(tt.errors, ",") {
+				t.Errorf("Check() errors = %q, want %q, problems: %v", errors, tt.errors, problems)
+			}
+			if HasError(problems) != (len(tt.errors) > 0) {
+				t.Errorf("HasError() = %v, want %v", HasError(problems), len(tt.errors) > 0)
+			}
+		})
+	}
+}
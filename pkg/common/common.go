@@ -10,20 +10,82 @@ import (
 )
 
 type Rule struct {
-	Name    string  `mapstructure:"name" yaml:"name"`
-	Expr    string  `mapstructure:"expr" yaml:"expr"`
-	Recover Recover `mapstructure:"recover" yaml:"recover"`
+	Name        string            `mapstructure:"name" yaml:"name"`
+	Expr        string            `mapstructure:"expr" yaml:"expr"`
+	Datasource  string            `mapstructure:"datasource" yaml:"datasource"` // 为空使用第一个datasource，all表示所有datasource
+	For         string            `mapstructure:"for" yaml:"for"`               // 持续时间，在for时间范围内每个采样点都满足条件才视为异常
+	Step        string            `mapstructure:"step" yaml:"step"`             // 覆盖全局step
+	Severity    string            `mapstructure:"severity" yaml:"severity"`
+	Annotations map[string]string `mapstructure:"annotations" yaml:"annotations"`
+	Recover     Recover           `mapstructure:"recover" yaml:"recover"`
+	Anomaly     *Anomaly          `mapstructure:"anomaly" yaml:"anomaly,omitempty"`   // 与历史基线比较，替代固定阈值
+	Forecast    *Forecast         `mapstructure:"forecast" yaml:"forecast,omitempty"` // 按趋势预测达到limit的时间
+}
+
+// Anomaly compares the current value of every series against its historical baseline
+type Anomaly struct {
+	Offsets   []string `mapstructure:"offsets" yaml:"offsets,omitempty"`     // 基线为1d、7d等偏移时间之前的值的平均值
+	Range     string   `mapstructure:"range" yaml:"range,omitempty"`         // 基线为之前一段时间(如1h)内的值，与offsets二选一
+	Method    string   `mapstructure:"method" yaml:"method,omitempty"`       // percent(默认)|zscore
+	Threshold float64  `mapstructure:"threshold" yaml:"threshold"`           // percent为偏离的百分比，zscore为标准差的倍数
+	Direction string   `mapstructure:"direction" yaml:"direction,omitempty"` // both(默认)|up|down
+}
+
+// Forecast fits a linear trend of every series and estimates when it reaches the limit
+type Forecast struct {
+	Range  string  `mapstructure:"range" yaml:"range"`             // 拟合趋势的时间范围，如7d
+	Limit  float64 `mapstructure:"limit" yaml:"limit"`             // 达到该值视为耗尽，如磁盘使用率100
+	Within string  `mapstructure:"within" yaml:"within,omitempty"` // 预计在该时间内达到limit的序列视为异常，为空时输出所有会达到limit的序列
+	// up(默认)为上升达到limit，如使用率；down为下降达到limit，如剩余空间
+	Direction string `mapstructure:"direction" yaml:"direction,omitempty"`
 }
 type Recover struct {
-	RecoveryType string `mapstructure:"type" yaml:"type"`
-	Action       string `mapstructure:"action" yaml:"action"`
-	Enable       bool   `mapstructure:"enable" yaml:"enable"`
+	RecoveryType string    `mapstructure:"type" yaml:"type"`
+	Action       string    `mapstructure:"action" yaml:"action"`
+	Enable       bool      `mapstructure:"enable" yaml:"enable"`
+	MaxTargets   int       `mapstructure:"max-targets" yaml:"max-targets,omitempty"`     // 单次运行的目标数超过该值时不处理该规则的任何目标
+	MaxPercent   float64   `mapstructure:"max-percent" yaml:"max-percent,omitempty"`     // 每个owner(无owner时为namespace)中同时处理的pod占比上限，向上取整
+	Cooldown     string    `mapstructure:"cooldown" yaml:"cooldown,omitempty"`           // 同一目标两次处理的最小间隔，如30m
+	DailyBudget  int       `mapstructure:"daily-budget" yaml:"daily-budget,omitempty"`   // 该规则24小时内最多处理的目标数
+	Timeout      string    `mapstructure:"timeout" yaml:"timeout,omitempty"`             // restart等待rollout完成、exec命令的超时时间，默认5m
+	EvictTimeout string    `mapstructure:"evict-timeout" yaml:"evict-timeout,omitempty"` // evict等待PodDisruptionBudget允许驱逐的超时时间，默认5m
+	GracePeriod  string    `mapstructure:"grace-period" yaml:"grace-period,omitempty"`   // delete、evict的pod终止宽限时间，如30s，为空使用pod的terminationGracePeriodSeconds
+	Container    string    `mapstructure:"container" yaml:"container,omitempty"`         // exec执行命令的容器名称，支持通配符，为空时使用默认容器
+	Include      *Selector `mapstructure:"include" yaml:"include,omitempty"`             // 只处理匹配所有条件的pod
+	Exclude      *Selector `mapstructure:"exclude" yaml:"exclude,omitempty"`             // 不处理匹配任一条件的pod
+	Verify       *Verify   `mapstructure:"verify" yaml:"verify,omitempty"`               // 处理后重新执行expr，检查目标是否恢复
+}
+
+// Verify re-evaluates the expr of the rule after the recovery, the targets still failing can be escalated to a second action
+type Verify struct {
+	Delay    string `mapstructure:"delay" yaml:"delay,omitempty"`       // 处理完成后等待多久重新执行expr，默认1m
+	Escalate string `mapstructure:"escalate" yaml:"escalate,omitempty"` // 仍然异常的目标执行的第二个action，如delete，为空时只记录结果
+}
+
+// Selector selects pods by namespace, name, labels and owner kind, the empty fields are ignored
+type Selector struct {
+	Namespaces []string `mapstructure:"namespaces" yaml:"namespaces,omitempty"`   // namespace名称，支持通配符，如kube-*
+	Pods       []string `mapstructure:"pods" yaml:"pods,omitempty"`               // pod名称的正则表达式，完整匹配
+	Labels     string   `mapstructure:"labels" yaml:"labels,omitempty"`           // kubernetes label selector，如app=mysql,tier!=web
+	OwnerKinds []string `mapstructure:"owner-kinds" yaml:"owner-kinds,omitempty"` // owner的kind，如DaemonSet、StatefulSet，静态pod为Node
 }
 
 const (
 	NAME              = "patrol"
 	OUTPUTFILEPREFIX  = NAME + "_prometheus_data"
+	RECOVERFILEPREFIX = NAME + "_recover"
 	DEFAULTCONFIGFILE = NAME + ".yaml"
+	DEFAULTDATASOURCE = "default"
+	ALLDATASOURCES    = "all"
+	LABELPREFIX       = NAME + "_"
+	FIRINGFORLABEL    = LABELPREFIX + "firing_for"
+	DEGRADEDLABEL     = LABELPREFIX + "degraded"
+	BASELINELABEL     = LABELPREFIX + "baseline"
+	DELTALABEL        = LABELPREFIX + "delta"
+	DEVIATIONLABEL    = LABELPREFIX + "deviation"
+	TIMETOLIMITLABEL  = LABELPREFIX + "time_to_limit"
+	LIMITATLABEL      = LABELPREFIX + "limit_at"
+	TRENDLABEL        = LABELPREFIX + "trend"
 )
 
 const (
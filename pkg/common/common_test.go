@@ -0,0 +1,64 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// TestRuleUnmarshal decodes the rules like the config file, through viper and mapstructure
+func TestRuleUnmarshal(t *testing.T) {
+	config := `
+rules:
+  - name: failed-pod
+    expr: kube_pod_status_phase{phase="Failed"} == 1
+    for: 5m
+    annotations:
+      summary: pod failed
+    recover:
+      type: pod
+      action: restart
+      enable: true
+      max-targets: 3
+      max-percent: 50
+      grace-period: 30s
+      include:
+        namespaces: [app-*]
+        owner-kinds: [StatefulSet]
+      verify:
+        delay: 2m
+        escalate: delete
+`
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var cfg struct {
+		Rules []Rule `mapstructure:"rules"`
+	}
+	if err := v.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := Rule{
+		Name:        "failed-pod",
+		Expr:        `kube_pod_status_phase{phase="Failed"} == 1`,
+		For:         "5m",
+		Annotations: map[string]string{"summary": "pod failed"},
+		Recover: Recover{
+			RecoveryType: "pod",
+			Action:       "restart",
+			Enable:       true,
+			MaxTargets:   3,
+			MaxPercent:   50,
+			GracePeriod:  "30s",
+			Include:      &Selector{Namespaces: []string{"app-*"}, OwnerKinds: []string{"StatefulSet"}},
+			Verify:       &Verify{Delay: "2m", Escalate: "delete"},
+		},
+	}
+	if len(cfg.Rules) != 1 || !reflect.DeepEqual(cfg.Rules[0], want) {
+		t.Errorf("rules = %+v, want %+v", cfg.Rules, want)
+	}
+}
@@ -0,0 +1,223 @@
+// engine evaluates PromQL in process, behind the same v1.API interface as a prometheus server
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// API queries the Queryable with the Engine.
+// Only Query, QueryRange, Series and LabelValues are implemented, Metadata returns an error
+// and the other methods of the embedded v1.API are not supported and panic.
+type API struct {
+	v1.API
+	Engine    *promql.Engine
+	Queryable storage.Queryable
+}
+
+// NewAPI returns a v1.API that evaluates the queries against the queryable
+func NewAPI(engine *promql.Engine, queryable storage.Queryable) v1.API {
+	return &API{Engine: engine, Queryable: queryable}
+}
+
+func (a *API) Query(ctx context.Context, query string, ts time.Time, _ ...v1.Option) (model.Value, v1.Warnings, error) {
+	q, err := a.Engine.NewInstantQuery(ctx, a.Queryable, nil, query, ts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer q.Close()
+	return convertResult(q.Exec(ctx), query)
+}
+
+func (a *API) QueryRange(ctx context.Context, query string, r v1.Range, _ ...v1.Option) (model.Value, v1.Warnings, error) {
+	q, err := a.Engine.NewRangeQuery(ctx, a.Queryable, nil, query, r.Start, r.End, r.Step)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer q.Close()
+	return convertResult(q.Exec(ctx), query)
+}
+
+func (a *API) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, v1.Warnings, error) {
+	querier, err := a.Queryable.Querier(startTime.UnixMilli(), endTime.UnixMilli())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer querier.Close()
+
+	var result []model.LabelSet
+	var warnings annotations.Annotations
+	seen := make(map[uint64]struct{})
+	for _, match := range matches {
+		matchers, err := parser.ParseMetricSelector(match)
+		if err != nil {
+			return nil, nil, err
+		}
+		set := querier.Select(ctx, false, nil, matchers...)
+		for set.Next() {
+			lset := set.At().Labels()
+			if _, ok := seen[lset.Hash()]; ok {
+				continue
+			}
+			seen[lset.Hash()] = struct{}{}
+			result = append(result, toLabelSet(lset))
+		}
+		if err := set.Err(); err != nil {
+			return nil, nil, err
+		}
+		warnings.Merge(set.Warnings())
+	}
+	return result, warnings.AsStrings("", 0), nil
+}
+
+func (a *API) LabelValues(ctx context.Context, label string, matches []string, startTime, endTime time.Time) (model.LabelValues, v1.Warnings, error) {
+	querier, err := a.Queryable.Querier(startTime.UnixMilli(), endTime.UnixMilli())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer querier.Close()
+
+	if len(matches) == 0 {
+		matches = []string{""}
+	}
+	var result model.LabelValues
+	var warnings annotations.Annotations
+	seen := make(map[string]struct{})
+	for _, match := range matches {
+		var matchers []*labels.Matcher
+		if match != "" {
+			if matchers, err = parser.ParseMetricSelector(match); err != nil {
+				return nil, nil, err
+			}
+		}
+		values, annos, err := querier.LabelValues(ctx, label, matchers...)
+		if err != nil {
+			return nil, nil, err
+		}
+		warnings.Merge(annos)
+		for _, v := range values {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			result = append(result, model.LabelValue(v))
+		}
+	}
+	return result, warnings.AsStrings("", 0), nil
+}
+
+func (a *API) Metadata(ctx context.Context, metric, limit string) (map[string][]v1.Metadata, error) {
+	return nil, fmt.Errorf("metadata is not supported by the in-process engine")
+}
+
+// convertResult converts the engine result to the client model, native histograms are dropped
+func convertResult(res *promql.Result, query string) (model.Value, v1.Warnings, error) {
+	warnings := res.Warnings.AsStrings(query, 0)
+	if res.Err != nil {
+		return nil, warnings, res.Err
+	}
+	switch v := res.Value.(type) {
+	case promql.Vector:
+		vector := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			if s.H != nil {
+				continue
+			}
+			vector = append(vector, &model.Sample{
+				Metric:    model.Metric(toLabelSet(s.Metric)),
+				Value:     model.SampleValue(s.F),
+				Timestamp: model.Time(s.T),
+			})
+		}
+		return vector, warnings, nil
+	case promql.Matrix:
+		matrix := make(model.Matrix, 0, len(v))
+		for _, s := range v {
+			if len(s.Floats) == 0 {
+				continue
+			}
+			stream := &model.SampleStream{Metric: model.Metric(toLabelSet(s.Metric))}
+			for _, p := range s.Floats {
+				stream.Values = append(stream.Values, model.SamplePair{
+					Timestamp: model.Time(p.T),
+					Value:     model.SampleValue(p.F),
+				})
+			}
+			matrix = append(matrix, stream)
+		}
+		return matrix, warnings, nil
+	case promql.Scalar:
+		return &model.Scalar{Value: model.SampleValue(v.V), Timestamp: model.Time(v.T)}, warnings, nil
+	case promql.String:
+		return &model.String{Value: v.V, Timestamp: model.Time(v.T)}, warnings, nil
+	default:
+		return nil, warnings, fmt.Errorf("unsupported result type %s", res.Value.Type())
+	}
+}
+
+func toLabelSet(lset labels.Labels) model.LabelSet {
+	ls := make(model.LabelSet, lset.Len())
+	lset.Range(func(l labels.Label) {
+		ls[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	})
+	return ls
+}
+
+// loadTimeout is the query timeout of the engine over the loaded series
+const loadTimeout = time.Minute
+
+// Load loads the series in the promql test notation ("load <interval>\n  <series> <values>")
+// till maxt into a memory storage and returns an API over them. The first sample of every series is at
+// the unix epoch. The storage is in memory, close does nothing and is kept for the callers.
+func Load(input string, maxt time.Time) (v1.API, func(), error) {
+	m := NewMemory()
+	var interval time.Duration
+	for i, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Fields(line); fields[0] == "load" {
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("line %d: invalid load command %q", i+1, line)
+			}
+			d, err := model.ParseDuration(fields[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: invalid load interval: %v", i+1, err)
+			}
+			interval = time.Duration(d)
+			continue
+		}
+		if interval == 0 {
+			return nil, nil, fmt.Errorf("line %d: series before the load command", i+1)
+		}
+		lset, values, err := parser.ParseSeriesDesc(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		for j, v := range values {
+			t := time.Unix(0, 0).Add(time.Duration(j) * interval)
+			if t.After(maxt) {
+				break
+			}
+			if v.Omitted {
+				continue
+			}
+			if v.Histogram != nil {
+				return nil, nil, fmt.Errorf("line %d: native histograms are not supported", i+1)
+			}
+			m.Add(lset, t.UnixMilli(), v.Value)
+		}
+	}
+	return NewAPI(NewEngine(loadTimeout), m), func() {}, nil
+}
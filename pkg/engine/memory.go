@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// Memory is a queryable of float samples kept in memory
+type Memory struct {
+	mu     sync.RWMutex
+	series map[uint64]*memSeries
+}
+
+type memSeries struct {
+	lset labels.Labels
+	// samples are sorted by timestamp
+	samples []chunks.Sample
+}
+
+// sample implements chunks.Sample for float samples
+type sample struct {
+	t int64
+	f float64
+}
+
+func (s sample) T() int64                      { return s.t }
+func (s sample) F() float64                    { return s.f }
+func (s sample) H() *histogram.Histogram       { return nil }
+func (s sample) FH() *histogram.FloatHistogram { return nil }
+func (s sample) Type() chunkenc.ValueType      { return chunkenc.ValFloat }
+
+// NewMemory returns an empty memory storage
+func NewMemory() *Memory {
+	return &Memory{series: make(map[uint64]*memSeries)}
+}
+
+// Add adds a sample to the series, the sample at the same timestamp is replaced
+func (m *Memory) Add(lset labels.Labels, t int64, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := lset.Hash()
+	s, ok := m.series[h]
+	if !ok {
+		s = &memSeries{lset: lset.Copy()}
+		m.series[h] = s
+	}
+	i := sort.Search(len(s.samples), func(i int) bool {
+		return s.samples[i].T() >= t
+	})
+	if i < len(s.samples) && s.samples[i].T() == t {
+		s.samples[i] = sample{t: t, f: v}
+		return
+	}
+	s.samples = append(s.samples, nil)
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = sample{t: t, f: v}
+}
+
+// Len returns the number of series
+func (m *Memory) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.series)
+}
+
+func (m *Memory) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &memQuerier{m: m, mint: mint, maxt: maxt}, nil
+}
+
+type memQuerier struct {
+	m          *Memory
+	mint, maxt int64
+}
+
+// matching returns the series matching all matchers, sorted by labels. The read lock must be held.
+func (q *memQuerier) matching(matchers []*labels.Matcher) []*memSeries {
+	var result []*memSeries
+	for _, s := range q.m.series {
+		matched := true
+		for _, matcher := range matchers {
+			if !matcher.Matches(s.lset.Get(matcher.Name)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return labels.Compare(result[i].lset, result[j].lset) < 0
+	})
+	return result
+}
+
+func (q *memQuerier) Select(_ context.Context, _ bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	mint, maxt := q.mint, q.maxt
+	if hints != nil {
+		mint, maxt = hints.Start, hints.End
+	}
+	var series []storage.Series
+	q.m.mu.RLock()
+	defer q.m.mu.RUnlock()
+	for _, s := range q.matching(matchers) {
+		var samples []chunks.Sample
+		for _, smpl := range s.samples {
+			if smpl.T() >= mint && smpl.T() <= maxt {
+				samples = append(samples, smpl)
+			}
+		}
+		if len(samples) > 0 {
+			series = append(series, storage.NewListSeries(s.lset, samples))
+		}
+	}
+	return &listSeriesSet{series: series, i: -1}
+}
+
+func (q *memQuerier) LabelValues(_ context.Context, name string, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	q.m.mu.RLock()
+	defer q.m.mu.RUnlock()
+	seen := make(map[string]struct{})
+	var values []string
+	for _, s := range q.matching(matchers) {
+		if !s.hasSamples(q.mint, q.maxt) {
+			continue
+		}
+		v := s.lset.Get(name)
+		if _, ok := seen[v]; ok || v == "" {
+			continue
+		}
+		seen[v] = struct{}{}
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values, nil, nil
+}
+
+func (q *memQuerier) LabelNames(_ context.Context, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	q.m.mu.RLock()
+	defer q.m.mu.RUnlock()
+	seen := make(map[string]struct{})
+	var names []string
+	for _, s := range q.matching(matchers) {
+		if !s.hasSamples(q.mint, q.maxt) {
+			continue
+		}
+		s.lset.Range(func(l labels.Label) {
+			if _, ok := seen[l.Name]; ok {
+				return
+			}
+			seen[l.Name] = struct{}{}
+			names = append(names, l.Name)
+		})
+	}
+	sort.Strings(names)
+	return names, nil, nil
+}
+
+// hasSamples returns true if the series has a sample between mint and maxt, like the series returned by Select
+func (s *memSeries) hasSamples(mint, maxt int64) bool {
+	for _, smpl := range s.samples {
+		if smpl.T() >= mint && smpl.T() <= maxt {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *memQuerier) Close() error {
+	return nil
+}
+
+// listSeriesSet is a storage.SeriesSet over a slice
+type listSeriesSet struct {
+	series []storage.Series
+	i      int
+}
+
+func (s *listSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *listSeriesSet) At() storage.Series                { return s.series[s.i] }
+func (s *listSeriesSet) Err() error                        { return nil }
+func (s *listSeriesSet) Warnings() annotations.Annotations { return nil }
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// openMetricsContentType selects the OpenMetrics parser, files without "# EOF" use the prometheus text format
+const openMetricsContentType = "application/openmetrics-text"
+
+// NewEngine returns an engine with the defaults of the prometheus server
+func NewEngine(timeout time.Duration) *promql.Engine {
+	return promql.NewEngine(promql.EngineOpts{
+		MaxSamples:           50000000,
+		Timeout:              timeout,
+		LookbackDelta:        5 * time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+}
+
+// LoadExposition adds the samples of a prometheus text or OpenMetrics exposition to the memory storage.
+// Samples without timestamp get the default timestamp, which is usually the time of the instant queries.
+// The target labels are added to the samples that do not have them. It returns the number of samples added.
+func (m *Memory) LoadExposition(content []byte, defaultTime time.Time, targetLabels map[string]string) (int, error) {
+	contentType := ""
+	if bytes.HasSuffix(bytes.TrimSpace(content), []byte("# EOF")) {
+		contentType = openMetricsContentType
+	}
+	p, err := textparse.New(content, contentType, false)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		entry, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+		_, ts, v := p.Series()
+		t := defaultTime.UnixMilli()
+		if ts != nil {
+			t = *ts
+		}
+		var lset labels.Labels
+		p.Metric(&lset)
+		if len(targetLabels) > 0 {
+			b := labels.NewBuilder(lset)
+			for name, value := range targetLabels {
+				if lset.Get(name) == "" {
+					b.Set(name, value)
+				}
+			}
+			lset = b.Labels()
+		}
+		m.Add(lset, t, v)
+		n++
+	}
+	return n, nil
+}
+
+// LoadFile adds the samples of an exposition file to the memory storage
+func (m *Memory) LoadFile(file string, defaultTime time.Time) (int, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	n, err := m.LoadExposition(content, defaultTime, nil)
+	if err != nil {
+		return n, fmt.Errorf("exposition file %s: %v", file, err)
+	}
+	return n, nil
+}
+
+// TSDB is a read only prometheus data directory, the blocks and the wal are loaded once
+type TSDB struct {
+	db      *tsdb.DBReadOnly
+	querier storage.Querier
+}
+
+// OpenTSDB opens a copy of a prometheus data directory read only
+func OpenTSDB(dir string) (*TSDB, error) {
+	db, err := tsdb.OpenDBReadOnly(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the read only db reloads the blocks and replays the wal for every querier,
+	// so a single querier over the whole data is kept and the range comes from the select hints
+	q, err := db.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &TSDB{db: db, querier: q}, nil
+}
+
+func (t *TSDB) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &tsdbQuerier{q: t.querier, mint: mint, maxt: maxt}, nil
+}
+
+// Close releases the blocks and the head of the data directory
+func (t *TSDB) Close() error {
+	t.querier.Close()
+	return t.db.Close()
+}
+
+// tsdbQuerier limits the shared querier to its range, closing it is a no-op
+type tsdbQuerier struct {
+	q          storage.Querier
+	mint, maxt int64
+}
+
+func (q *tsdbQuerier) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	if hints == nil {
+		hints = &storage.SelectHints{Start: q.mint, End: q.maxt}
+	}
+	return q.q.Select(ctx, sortSeries, hints, matchers...)
+}
+
+// LabelValues returns the values of the label of the series with samples in the range of the querier
+func (q *tsdbQuerier) LabelValues(ctx context.Context, name string, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	matchers = append(matchers, labels.MustNewMatcher(labels.MatchRegexp, name, ".+"))
+	seen := make(map[string]struct{})
+	var values []string
+	warnings, err := q.inRange(ctx, matchers, func(lset labels.Labels) {
+		v := lset.Get(name)
+		if _, ok := seen[v]; ok {
+			return
+		}
+		seen[v] = struct{}{}
+		values = append(values, v)
+	})
+	sort.Strings(values)
+	return values, warnings, err
+}
+
+// LabelNames returns the label names of the series with samples in the range of the querier
+func (q *tsdbQuerier) LabelNames(ctx context.Context, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	if len(matchers) == 0 {
+		matchers = []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".*")}
+	}
+	seen := make(map[string]struct{})
+	var names []string
+	warnings, err := q.inRange(ctx, matchers, func(lset labels.Labels) {
+		lset.Range(func(l labels.Label) {
+			if _, ok := seen[l.Name]; ok {
+				return
+			}
+			seen[l.Name] = struct{}{}
+			names = append(names, l.Name)
+		})
+	})
+	sort.Strings(names)
+	return names, warnings, err
+}
+
+// inRange calls f with the labels of every series matching the matchers with a sample in the range of the querier
+func (q *tsdbQuerier) inRange(ctx context.Context, matchers []*labels.Matcher, f func(labels.Labels)) (annotations.Annotations, error) {
+	set := q.Select(ctx, false, nil, matchers...)
+	var it chunkenc.Iterator
+	for set.Next() {
+		series := set.At()
+		it = series.Iterator(it)
+		for it.Next() != chunkenc.ValNone {
+			if t := it.AtT(); t >= q.mint && t <= q.maxt {
+				f(series.Labels())
+				break
+			}
+		}
+		if err := it.Err(); err != nil {
+			return set.Warnings(), err
+		}
+	}
+	return set.Warnings(), set.Err()
+}
+
+func (q *tsdbQuerier) Close() error {
+	return nil
+}
@@ -0,0 +1,193 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// anomaly methods
+const (
+	AnomalyPercent = "percent"
+	AnomalyZScore  = "zscore"
+)
+
+// anomaly directions
+const (
+	DirectionBoth = "both"
+	DirectionUp   = "up"
+	DirectionDown = "down"
+)
+
+// baseline is the historical values of a series
+type baseline struct {
+	values []float64
+}
+
+func (b *baseline) mean() float64 {
+	sum := 0.0
+	for _, v := range b.values {
+		sum += v
+	}
+	return sum / float64(len(b.values))
+}
+
+// stddev returns the population standard deviation of the values
+func (b *baseline) stddev() float64 {
+	mean := b.mean()
+	sum := 0.0
+	for _, v := range b.values {
+		sum += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sum / float64(len(b.values)))
+}
+
+// anomalyQuery evaluates the expr at the query time and compares every series against its baseline,
+// the values at the offsets before or the values over the range before. Only the outliers are returned,
+// with the current value and the baseline, delta and deviation labels.
+func (p *PromQL) anomalyQuery(client v1.API, rule common.Rule) (model.Vector, v1.Warnings, error) {
+	current, warnings, err := p.instantQuery(client, rule.Expr)
+	if err != nil {
+		return nil, warnings, err
+	}
+	baselines, w, err := p.queryBaselines(client, rule)
+	warnings = append(warnings, w...)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return outliers(current, baselines, *rule.Anomaly), warnings, nil
+}
+
+// queryBaselines returns the historical values of every series, by the fingerprint of its labels
+func (p *PromQL) queryBaselines(client v1.API, rule common.Rule) (map[model.Fingerprint]*baseline, v1.Warnings, error) {
+	anomaly := rule.Anomaly
+	baselines := make(map[model.Fingerprint]*baseline)
+	add := func(metric model.Metric, v model.SampleValue) {
+		fp := metric.Fingerprint()
+		b, ok := baselines[fp]
+		if !ok {
+			b = &baseline{}
+			baselines[fp] = b
+		}
+		b.values = append(b.values, float64(v))
+	}
+
+	var warnings v1.Warnings
+	if anomaly.Range != "" {
+		d, err := model.ParseDuration(anomaly.Range)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse anomaly range, %v", err)
+		}
+		step, err := p.getRuleStep(rule, time.Duration(d))
+		if err != nil {
+			return nil, nil, err
+		}
+		// the range ends one step before the query time so that the current value is not part of the baseline
+		r := v1.Range{
+			Start: p.Time.Add(-time.Duration(d)),
+			End:   p.Time.Add(-step),
+			Step:  step,
+		}
+		matrix, w, err := p.queryRange(client, rule.Expr, r)
+		if err != nil {
+			return nil, w, err
+		}
+		warnings = append(warnings, w...)
+		for _, s := range matrix {
+			for _, v := range s.Values {
+				add(s.Metric, v.Value)
+			}
+		}
+		return baselines, warnings, nil
+	}
+
+	for _, offset := range anomaly.Offsets {
+		d, err := model.ParseDuration(offset)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse anomaly offset, %v", err)
+		}
+		vector, w, err := p.instantQueryAt(client, rule.Expr, p.Time.Add(-time.Duration(d)))
+		if err != nil {
+			return nil, w, fmt.Errorf("offset %s: %v", offset, err)
+		}
+		warnings = append(warnings, w...)
+		for _, s := range vector {
+			add(s.Metric, s.Value)
+		}
+	}
+	return baselines, warnings, nil
+}
+
+// outliers returns the series of the current vector which deviate from their baseline over the threshold.
+// Series without baseline are new and skipped.
+func outliers(current model.Vector, baselines map[model.Fingerprint]*baseline, anomaly common.Anomaly) model.Vector {
+	var vector model.Vector
+	for _, s := range current {
+		b, ok := baselines[s.Metric.Fingerprint()]
+		if !ok {
+			glog.V(4).Infof("Anomaly: no baseline of %s, skipped", s.Metric)
+			continue
+		}
+		value := float64(s.Value)
+		mean := b.mean()
+		delta := value - mean
+
+		var deviation float64
+		var deviationStr string
+		switch anomaly.Method {
+		case AnomalyZScore:
+			deviation = ratio(delta, b.stddev())
+			deviationStr = "z=" + formatFloat(deviation)
+		default:
+			deviation = ratio(delta, math.Abs(mean)) * 100
+			deviationStr = formatFloat(deviation) + "%"
+		}
+
+		var flagged bool
+		switch anomaly.Direction {
+		case DirectionUp:
+			flagged = deviation >= anomaly.Threshold
+		case DirectionDown:
+			flagged = -deviation >= anomaly.Threshold
+		default:
+			flagged = math.Abs(deviation) >= anomaly.Threshold
+		}
+		if !flagged {
+			continue
+		}
+
+		metric := s.Metric.Clone()
+		metric[common.BASELINELABEL] = model.LabelValue(formatFloat(mean))
+		metric[common.DELTALABEL] = model.LabelValue(formatFloat(delta))
+		metric[common.DEVIATIONLABEL] = model.LabelValue(deviationStr)
+		vector = append(vector, &model.Sample{
+			Metric:    metric,
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+		})
+	}
+	return vector
+}
+
+// ratio divides the delta, a zero divisor is an infinite deviation unless the delta is zero too
+func ratio(delta, divisor float64) float64 {
+	if divisor == 0 {
+		if delta == 0 {
+			return 0
+		}
+		return math.Copysign(math.Inf(1), delta)
+	}
+	return delta / divisor
+}
+
+// formatFloat formats the value with at most 2 decimals
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,107 @@
+package promql
+
+import (
+	"testing"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestOutliers(t *testing.T) {
+	metric := func(pod string) model.Metric {
+		return model.Metric{"pod": model.LabelValue(pod)}
+	}
+	baselines := map[model.Fingerprint]*baseline{
+		metric("a").Fingerprint(): {values: []float64{100, 100}},
+		metric("b").Fingerprint(): {values: []float64{90, 100, 110}},
+		metric("c").Fingerprint(): {values: []float64{200, 200}},
+		metric("d").Fingerprint(): {values: []float64{50, 50}},
+	}
+	// e has no baseline and is never an outlier
+	current := model.Vector{
+		{Metric: metric("a"), Value: 130},
+		{Metric: metric("b"), Value: 110},
+		{Metric: metric("c"), Value: 140},
+		{Metric: metric("d"), Value: 50},
+		{Metric: metric("e"), Value: 1},
+	}
+
+	tests := []struct {
+		name    string
+		anomaly common.Anomaly
+		// deviation label of every outlier by pod
+		want map[string]string
+	}{
+		{
+			name:    "percent both",
+			anomaly: common.Anomaly{Threshold: 20},
+			want:    map[string]string{"a": "30%", "c": "-30%"},
+		},
+		{
+			name:    "percent up",
+			anomaly: common.Anomaly{Method: AnomalyPercent, Threshold: 20, Direction: DirectionUp},
+			want:    map[string]string{"a": "30%"},
+		},
+		{
+			name:    "percent down",
+			anomaly: common.Anomaly{Method: AnomalyPercent, Threshold: 20, Direction: DirectionDown},
+			want:    map[string]string{"c": "-30%"},
+		},
+		{
+			name:    "percent over threshold",
+			anomaly: common.Anomaly{Threshold: 50},
+			want:    map[string]string{},
+		},
+		{
+			name:    "zscore both",
+			anomaly: common.Anomaly{Method: AnomalyZScore, Threshold: 1},
+			want:    map[string]string{"a": "z=+Inf", "b": "z=1.22", "c": "z=-Inf"},
+		},
+		{
+			name:    "zscore up",
+			anomaly: common.Anomaly{Method: AnomalyZScore, Threshold: 1, Direction: DirectionUp},
+			want:    map[string]string{"a": "z=+Inf", "b": "z=1.22"},
+		},
+		{
+			name:    "zscore down",
+			anomaly: common.Anomaly{Method: AnomalyZScore, Threshold: 1, Direction: DirectionDown},
+			want:    map[string]string{"c": "z=-Inf"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := outliers(current, baselines, tt.anomaly)
+			if len(got) != len(tt.want) {
+				t.Fatalf("outliers() = %v, want the pods %v", got, tt.want)
+			}
+			for _, s := range got {
+				pod := string(s.Metric["pod"])
+				want, ok := tt.want[pod]
+				if !ok {
+					t.Errorf("pod %s should not be an outlier", pod)
+					continue
+				}
+				if d := string(s.Metric[common.DEVIATIONLABEL]); d != want {
+					t.Errorf("pod %s deviation = %s, want %s", pod, d, want)
+				}
+			}
+		})
+	}
+
+	// the outlier keeps its value with the baseline and delta labels
+	got := outliers(current, baselines, common.Anomaly{Threshold: 20, Direction: DirectionUp})
+	if len(got) != 1 {
+		t.Fatalf("outliers() = %v, want a single series", got)
+	}
+	s := got[0]
+	if s.Value != 130 {
+		t.Errorf("value = %v, want 130", s.Value)
+	}
+	if b := s.Metric[common.BASELINELABEL]; b != "100" {
+		t.Errorf("baseline = %s, want 100", b)
+	}
+	if d := s.Metric[common.DELTALABEL]; d != "30" {
+		t.Errorf("delta = %s, want 30", d)
+	}
+}
@@ -0,0 +1,306 @@
+package promql
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/engine"
+
+	"github.com/golang/glog"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/config"
+)
+
+// HTTPConfig configures the http client used to query a datasource.
+// It accepts every option of the prometheus http client config,
+// e.g. basic_auth, authorization, oauth2, bearer_token_file, tls_config, proxy_url and follow_redirects.
+type HTTPConfig struct {
+	HTTPClientConfig config.HTTPClientConfig `yaml:",inline"`
+	// Headers are set on every request, e.g. X-Scope-OrgID for Thanos/Mimir
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *HTTPConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = HTTPConfig{HTTPClientConfig: config.DefaultHTTPClientConfig}
+	type plain HTTPConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return c.HTTPClientConfig.Validate()
+}
+
+// datasource types
+const (
+	// PrometheusDatasource queries a prometheus server
+	PrometheusDatasource = "prometheus"
+	// FileDatasource evaluates the rules in process against exposition format files, e.g. node_exporter dumps
+	FileDatasource = "file"
+	// TSDBDatasource evaluates the rules in process against a copy of a prometheus data directory
+	TSDBDatasource = "tsdb"
+)
+
+// Datasource is a named prometheus server, or offline data, that rules can be evaluated against
+type Datasource struct {
+	Name string `yaml:"name"`
+	// Type is prometheus (default), file or tsdb
+	Type string `yaml:"type,omitempty"`
+	URL  string `yaml:"url"`
+	// Files are the exposition format files of the file datasource, glob patterns are supported
+	Files []string `yaml:"files,omitempty"`
+	// Path is the data directory of the tsdb datasource
+	Path string `yaml:"path,omitempty"`
+	// Scrape lists the exporters of the scrape datasource
+	Scrape ScrapeConfig `yaml:"scrape,omitempty"`
+	// Fallback is the datasource the rules are evaluated against when this datasource fails
+	Fallback   string     `yaml:"fallback,omitempty"`
+	HTTPConfig HTTPConfig `yaml:",inline"`
+	Client     v1.API     `yaml:"-"`
+	closer     io.Closer
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ds *Datasource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*ds = Datasource{HTTPConfig: HTTPConfig{HTTPClientConfig: config.DefaultHTTPClientConfig}}
+	type plain Datasource
+	if err := unmarshal((*plain)(ds)); err != nil {
+		return err
+	}
+	return ds.HTTPConfig.HTTPClientConfig.Validate()
+}
+
+// DatasourceConfig is the datasources section of the config file
+type DatasourceConfig struct {
+	Datasources []Datasource `yaml:"datasources"`
+	// HTTPConfig is used by the default datasource created from the host flag
+	HTTPConfig *HTTPConfig `yaml:"http_config"`
+}
+
+// SetDirectory joins the relative file paths of all http configs and offline datasources with dir
+func (c *DatasourceConfig) SetDirectory(dir string) {
+	for i := range c.Datasources {
+		ds := &c.Datasources[i]
+		ds.HTTPConfig.HTTPClientConfig.SetDirectory(dir)
+		for j := range ds.Files {
+			ds.Files[j] = config.JoinDir(dir, ds.Files[j])
+		}
+		ds.Path = config.JoinDir(dir, ds.Path)
+	}
+	if c.HTTPConfig != nil {
+		c.HTTPConfig.HTTPClientConfig.SetDirectory(dir)
+	}
+}
+
+// defaultHTTPConfig merges the auth and tls flags into the http_config of the config file
+func (p *PromQL) defaultHTTPConfig() (HTTPConfig, error) {
+	httpCfg := HTTPConfig{HTTPClientConfig: config.DefaultHTTPClientConfig}
+	httpCfg.HTTPClientConfig.ProxyFromEnvironment = true
+	if p.HTTPConfig != nil {
+		httpCfg = *p.HTTPConfig
+	}
+
+	authCfg := p.Auth
+	if authCfg != (config.Authorization{}) {
+		switch {
+		case authCfg.Type == "":
+			return httpCfg, fmt.Errorf("please specify an authentication type, run promql --help for more details")
+		case authCfg.Credentials != "" && authCfg.CredentialsFile != "":
+			return httpCfg, fmt.Errorf("please specify either auth credentials or an auth credential file, not both")
+		}
+		httpCfg.HTTPClientConfig.Authorization = &authCfg
+	}
+	if p.TLSConfig != (config.TLSConfig{}) {
+		httpCfg.HTTPClientConfig.TLSConfig = p.TLSConfig
+	}
+	return httpCfg, nil
+}
+
+// InitDatasources creates a client for every datasource.
+// If no datasource is configured, the host/auth/tls flags and http_config are used as the default datasource.
+func (p *PromQL) InitDatasources() error {
+	if len(p.Datasources) == 0 {
+		httpCfg, err := p.defaultHTTPConfig()
+		if err != nil {
+			return err
+		}
+		p.Datasources = []Datasource{{
+			Name:       common.DEFAULTDATASOURCE,
+			URL:        p.Host,
+			HTTPConfig: httpCfg,
+		}}
+	}
+	names := make(map[string]struct{})
+	for i := range p.Datasources {
+		ds := &p.Datasources[i]
+		if ds.Name == "" {
+			return fmt.Errorf("datasource %d: name is required", i)
+		}
+		if ds.Name == common.ALLDATASOURCES {
+			return fmt.Errorf("datasource %s: name is reserved", ds.Name)
+		}
+		if _, ok := names[ds.Name]; ok {
+			return fmt.Errorf("datasource %s: duplicate name", ds.Name)
+		}
+		names[ds.Name] = struct{}{}
+
+		cl, err := p.createClient(ds)
+		if err != nil {
+			return fmt.Errorf("datasource %s: %v", ds.Name, err)
+		}
+		ds.Client = cl
+	}
+	for _, ds := range p.Datasources {
+		if ds.Fallback == "" {
+			continue
+		}
+		if ds.Fallback == ds.Name {
+			return fmt.Errorf("datasource %s: fallback to itself", ds.Name)
+		}
+		if _, ok := names[ds.Fallback]; !ok {
+			return fmt.Errorf("datasource %s: fallback datasource %s not found", ds.Name, ds.Fallback)
+		}
+	}
+	// the first datasource is used by rules without a datasource and by the metadata queries
+	p.Client = p.Datasources[0].Client
+	return nil
+}
+
+// createClient creates the client of the datasource, serving the recorded responses when replaying
+// and recording the responses when recording
+func (p *PromQL) createClient(ds *Datasource) (v1.API, error) {
+	switch ds.Type {
+	case "", PrometheusDatasource:
+	case FileDatasource:
+		return p.createFileClient(ds)
+	case ScrapeDatasource:
+		return p.createScrapeClient(ds)
+	case TSDBDatasource:
+		if ds.Path == "" {
+			return nil, fmt.Errorf("path is required by the tsdb datasource")
+		}
+		db, err := engine.OpenTSDB(ds.Path)
+		if err != nil {
+			return nil, fmt.Errorf("open tsdb %s: %v", ds.Path, err)
+		}
+		ds.closer = db
+		return engine.NewAPI(engine.NewEngine(p.TimeoutDuration), db), nil
+	default:
+		return nil, fmt.Errorf("unknown datasource type %s", ds.Type)
+	}
+	if p.Replayer != nil {
+		return p.Replayer.Client(ds.Name), nil
+	}
+	if ds.URL == "" {
+		ds.URL = p.discoverHost()
+	}
+	var host string
+	var rt http.RoundTripper
+	var err error
+	if isKubeServiceAddress(ds.URL) {
+		host, rt, err = kubeProxyTransport(ds.URL, p.KubeBuilder)
+	} else {
+		host = ds.URL
+		rt, err = newRoundTripper(ds.HTTPConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Recorder != nil {
+		rt = p.Recorder.RoundTripper(ds.Name, rt)
+	}
+	return newAPI(host, rt, ds.HTTPConfig)
+}
+
+// createFileClient loads the exposition files in memory,
+// samples without timestamp are stamped with the time of the instant queries
+func (p *PromQL) createFileClient(ds *Datasource) (v1.API, error) {
+	if len(ds.Files) == 0 {
+		return nil, fmt.Errorf("files are required by the file datasource")
+	}
+	m := engine.NewMemory()
+	for _, pattern := range ds.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("files %s: %v", pattern, err)
+		}
+		if len(files) == 0 {
+			glog.Warningf("No exposition file matches %s", pattern)
+		}
+		for _, file := range files {
+			n, err := m.LoadFile(file, p.Time)
+			if err != nil {
+				return nil, err
+			}
+			glog.V(4).Infof("Loaded %d samples from %s", n, file)
+		}
+	}
+	glog.Infof("Datasource %s: loaded %d series", ds.Name, m.Len())
+	return engine.NewAPI(engine.NewEngine(p.TimeoutDuration), m), nil
+}
+
+// Close releases the offline datasources
+func (p *PromQL) Close() {
+	for _, ds := range p.Datasources {
+		if ds.closer != nil {
+			if err := ds.closer.Close(); err != nil {
+				glog.Warningf("Close datasource %s error: %v", ds.Name, err)
+			}
+		}
+	}
+}
+
+// discoverHost returns the address of the prometheus discovered in the cluster, or DefaultHost if not found
+func (p *PromQL) discoverHost() string {
+	host, err := DiscoverPrometheus(p.KubeBuilder)
+	if err != nil {
+		glog.Warningf("Discover prometheus error: %v, using %s", err, DefaultHost)
+		return DefaultHost
+	}
+	return host
+}
+
+// getDatasource returns the datasource with the name
+func (p *PromQL) getDatasource(name string) *Datasource {
+	for i := range p.Datasources {
+		if p.Datasources[i].Name == name {
+			return &p.Datasources[i]
+		}
+	}
+	return nil
+}
+
+// GetDatasources returns the datasources the rule should be evaluated against
+func (p *PromQL) GetDatasources(rule common.Rule) ([]*Datasource, error) {
+	switch rule.Datasource {
+	case "":
+		return []*Datasource{&p.Datasources[0]}, nil
+	case common.ALLDATASOURCES:
+		var dsList []*Datasource
+		for i := range p.Datasources {
+			dsList = append(dsList, &p.Datasources[i])
+		}
+		return dsList, nil
+	default:
+		if ds := p.getDatasource(rule.Datasource); ds != nil {
+			return []*Datasource{ds}, nil
+		}
+		return nil, fmt.Errorf("rule %s: datasource %s not found", rule.Name, rule.Datasource)
+	}
+}
+
+// headersRoundTripper sets the configured headers on every request
+type headersRoundTripper struct {
+	headers map[string]string
+	rt      http.RoundTripper
+}
+
+func (h *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	return h.rt.RoundTrip(req)
+}
@@ -0,0 +1,82 @@
+package promql
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// getRuleStep returns the step of the rule, falling back to the step flag and then the auto step of the window
+func (p *PromQL) getRuleStep(rule common.Rule, window time.Duration) (time.Duration, error) {
+	step := rule.Step
+	if step == "" {
+		step = p.Step
+	}
+	return parseStep(step, window)
+}
+
+// firingLookback is the multiple of the for duration looked back to measure how long the series have been firing
+const firingLookback = 4
+
+// forQuery evaluates a rule with a for duration like a prometheus alerting rule.
+// The expr is queried at the rule's step over a lookback of several for durations ending at the evaluation time,
+// and only the series whose condition held for every sample of at least the for duration are returned,
+// with their latest sample.
+func (p *PromQL) forQuery(client v1.API, rule common.Rule) (model.Vector, v1.Warnings, error) {
+	forDuration, err := model.ParseDuration(rule.For)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse for duration, %v", err)
+	}
+	step, err := p.getRuleStep(rule, time.Duration(forDuration))
+	if err != nil {
+		return nil, nil, err
+	}
+	// the lookback is a whole number of steps, so that the last step is the evaluation time
+	steps := (firingLookback*time.Duration(forDuration) + step - 1) / step
+	r := v1.Range{
+		Start: p.Time.Add(-steps * step),
+		End:   p.Time,
+		Step:  step,
+	}
+	matrix, warnings, err := p.queryRange(client, rule.Expr, r)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return firingSeries(matrix, r, time.Duration(forDuration)), warnings, nil
+}
+
+// firingSeries returns the latest sample of every series whose samples are unbroken from at least the for duration
+// before the end of the range up to the end. The length of the unbroken run is added as the firing for label,
+// at most the length of the range.
+func firingSeries(matrix model.Matrix, r v1.Range, forDuration time.Duration) model.Vector {
+	required := int(forDuration/r.Step) + 1
+	end := model.TimeFromUnixNano(r.End.UnixNano())
+	var vector model.Vector
+	for _, series := range matrix {
+		n := len(series.Values)
+		if n == 0 || end.Sub(series.Values[n-1].Timestamp) >= r.Step {
+			continue
+		}
+		// walk back while the samples are one step apart
+		first := n - 1
+		for first > 0 && series.Values[first].Timestamp.Sub(series.Values[first-1].Timestamp) < r.Step*3/2 {
+			first--
+		}
+		if n-first < required {
+			continue
+		}
+		last := series.Values[n-1]
+		metric := series.Metric.Clone()
+		metric[common.FIRINGFORLABEL] = model.LabelValue(model.Duration(last.Timestamp.Sub(series.Values[first].Timestamp)).String())
+		vector = append(vector, &model.Sample{
+			Metric:    metric,
+			Value:     last.Value,
+			Timestamp: last.Timestamp,
+		})
+	}
+	return vector
+}
@@ -0,0 +1,56 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestFiringSeries(t *testing.T) {
+	end := time.Unix(1700000000, 0)
+	r := v1.Range{
+		Start: end.Add(-40 * time.Minute),
+		End:   end,
+		Step:  5 * time.Minute,
+	}
+	samples := func(offsets ...int) []model.SamplePair {
+		var values []model.SamplePair
+		for _, o := range offsets {
+			values = append(values, model.SamplePair{
+				Timestamp: model.TimeFromUnix(r.Start.Unix() + int64(o*60)),
+				Value:     1,
+			})
+		}
+		return values
+	}
+	matrix := model.Matrix{
+		{Metric: model.Metric{"pod": "firing"}, Values: samples(30, 35, 40)},
+		{Metric: model.Metric{"pod": "long"}, Values: samples(0, 5, 10, 15, 20, 25, 30, 35, 40)},
+		{Metric: model.Metric{"pod": "flapping"}, Values: samples(0, 5, 10, 15, 25, 30, 35, 40)},
+		{Metric: model.Metric{"pod": "pending"}, Values: samples(35, 40)},
+		{Metric: model.Metric{"pod": "resolved"}, Values: samples(0, 5, 10, 15, 20, 25, 30, 35)},
+	}
+
+	want := map[model.LabelValue]model.LabelValue{
+		"firing":   "10m",
+		"long":     "40m",
+		"flapping": "15m",
+	}
+	vector := firingSeries(matrix, r, 10*time.Minute)
+	if len(vector) != len(want) {
+		t.Fatalf("firingSeries() returned %d series, want %d", len(vector), len(want))
+	}
+	for _, s := range vector {
+		pod := s.Metric["pod"]
+		if got := s.Metric[common.FIRINGFORLABEL]; got != want[pod] {
+			t.Errorf("firingSeries() %s firing for = %v, want %v", pod, got, want[pod])
+		}
+		if got := s.Timestamp; !got.Equal(model.TimeFromUnix(end.Unix())) {
+			t.Errorf("firingSeries() %s timestamp = %v, want %v", pod, got, end)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// trend is the linear regression of a series, value = slope * t + intercept with t in unix seconds
+type trend struct {
+	slope     float64
+	intercept float64
+}
+
+func (t trend) at(ts time.Time) float64 {
+	return t.slope*float64(ts.UnixMilli())/1000 + t.intercept
+}
+
+// fitTrend returns the least squares linear regression of the samples,
+// false if there are less than 2 samples or they are all at the same time
+func fitTrend(values []model.SamplePair) (trend, bool) {
+	n := float64(len(values))
+	if n < 2 {
+		return trend{}, false
+	}
+	// center the timestamps to keep the precision of the sums
+	t0 := float64(values[0].Timestamp) / 1000
+	var sumX, sumY, sumXY, sumXX float64
+	for _, v := range values {
+		x := float64(v.Timestamp)/1000 - t0
+		y := float64(v.Value)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return trend{}, false
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+	return trend{slope: slope, intercept: intercept - slope*t0}, true
+}
+
+// timeToLimit returns the time from ts until the trend reaches the limit rising, or falling if down is set,
+// false if it never reaches it. It is 0 if the trend is already at or beyond the limit.
+func (t trend) timeToLimit(ts time.Time, limit float64, down bool) (time.Duration, bool) {
+	value, slope := t.at(ts), t.slope
+	if down {
+		value, limit, slope = -value, -limit, -slope
+	}
+	switch {
+	case value >= limit:
+		return 0, true
+	case slope <= 0:
+		return 0, false
+	}
+	seconds := (limit - value) / slope
+	if seconds > math.MaxInt64/float64(time.Second) {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// forecastQuery queries the expr over the forecast range and fits a linear trend of every series.
+// The series reaching the limit within the within duration are returned with their last value,
+// the estimated time to the limit, the time it is reached and the trend per day.
+func (p *PromQL) forecastQuery(client v1.API, rule common.Rule) (model.Vector, v1.Warnings, error) {
+	forecast := rule.Forecast
+	d, err := model.ParseDuration(forecast.Range)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse forecast range, %v", err)
+	}
+	within := time.Duration(math.MaxInt64)
+	if forecast.Within != "" {
+		w, err := model.ParseDuration(forecast.Within)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse forecast within, %v", err)
+		}
+		within = time.Duration(w)
+	}
+	step, err := p.getRuleStep(rule, time.Duration(d))
+	if err != nil {
+		return nil, nil, err
+	}
+	r := v1.Range{
+		Start: p.Time.Add(-time.Duration(d)),
+		End:   p.Time,
+		Step:  step,
+	}
+	matrix, warnings, err := p.queryRange(client, rule.Expr, r)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return forecastSeries(matrix, p.Time, p.Location, *forecast, within), warnings, nil
+}
+
+// forecastSeries returns the series of the matrix whose trend reaches the limit of the forecast within the duration
+// after now, the time it is reached is rendered in the timezone, nil is the local timezone
+func forecastSeries(matrix model.Matrix, now time.Time, loc *time.Location, forecast common.Forecast, within time.Duration) model.Vector {
+	if loc == nil {
+		loc = time.Local
+	}
+	var vector model.Vector
+	for _, series := range matrix {
+		t, ok := fitTrend(series.Values)
+		if !ok {
+			continue
+		}
+		eta, ok := t.timeToLimit(now, forecast.Limit, forecast.Direction == DirectionDown)
+		if !ok || eta > within {
+			continue
+		}
+		last := series.Values[len(series.Values)-1]
+		metric := series.Metric.Clone()
+		metric[common.TIMETOLIMITLABEL] = model.LabelValue(model.Duration(eta.Truncate(time.Minute)).String())
+		metric[common.LIMITATLABEL] = model.LabelValue(now.Add(eta).Truncate(time.Minute).In(loc).Format(time.RFC3339))
+		perDay := formatFloat(t.slope * 86400)
+		if t.slope > 0 {
+			perDay = "+" + perDay
+		}
+		metric[common.TRENDLABEL] = model.LabelValue(perDay + "/d")
+		vector = append(vector, &model.Sample{
+			Metric:    metric,
+			Value:     last.Value,
+			Timestamp: last.Timestamp,
+		})
+	}
+	return vector
+}
@@ -0,0 +1,115 @@
+package promql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestFitTrend(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	var values []model.SamplePair
+	for i := 0; i < 10; i++ {
+		ts := start.Add(time.Duration(i) * time.Hour)
+		// 2 per hour from 50, with noise around the line
+		noise := 0.5
+		if i%2 == 1 {
+			noise = -0.5
+		}
+		values = append(values, model.SamplePair{
+			Timestamp: model.TimeFromUnixNano(ts.UnixNano()),
+			Value:     model.SampleValue(50 + 2*float64(i) + noise),
+		})
+	}
+	tr, ok := fitTrend(values)
+	if !ok {
+		t.Fatal("fitTrend() failed")
+	}
+	if perHour := tr.slope * 3600; math.Abs(perHour-2) > 0.2 {
+		t.Errorf("slope = %v per hour, want about 2", perHour)
+	}
+	if got := tr.at(start); math.Abs(got-50) > 1 {
+		t.Errorf("value at start = %v, want about 50", got)
+	}
+
+	if _, ok := fitTrend(values[:1]); ok {
+		t.Errorf("fitTrend() of a single sample should fail")
+	}
+	falling := trend{slope: -1, intercept: 50 + float64(start.Unix())}
+	if _, ok := falling.timeToLimit(start, 100, false); ok {
+		t.Errorf("a falling trend should never reach the upper limit")
+	}
+	if eta, ok := falling.timeToLimit(start, 20, true); !ok || eta != 30*time.Second {
+		t.Errorf("timeToLimit() of a falling trend to the lower limit = %v, %v, want 30s, true", eta, ok)
+	}
+	// already at or beyond the limit
+	if eta, ok := tr.timeToLimit(start.Add(9*time.Hour), 60, false); !ok || eta != 0 {
+		t.Errorf("timeToLimit() of a rising trend beyond the limit = %v, %v, want 0, true", eta, ok)
+	}
+	if eta, ok := falling.timeToLimit(start.Add(time.Minute), 45, true); !ok || eta != 0 {
+		t.Errorf("timeToLimit() of a falling trend beyond the lower limit = %v, %v, want 0, true", eta, ok)
+	}
+	// above the limit for the whole range and still rising
+	if eta, ok := tr.timeToLimit(start.Add(9*time.Hour), 40, false); !ok || eta != 0 {
+		t.Errorf("timeToLimit() of a rising trend above the limit since the start = %v, %v, want 0, true", eta, ok)
+	}
+}
+
+func TestForecastSeries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	series := func(last, perHour float64) []model.SamplePair {
+		var values []model.SamplePair
+		for i := 24; i >= 0; i-- {
+			ts := now.Add(-time.Duration(i) * time.Hour)
+			values = append(values, model.SamplePair{
+				Timestamp: model.TimeFromUnixNano(ts.UnixNano()),
+				Value:     model.SampleValue(last - perHour*float64(i)),
+			})
+		}
+		return values
+	}
+	matrix := model.Matrix{
+		{Metric: model.Metric{"mountpoint": "/"}, Values: series(80, 1)},
+		{Metric: model.Metric{"mountpoint": "/data"}, Values: series(80, 0.1)},
+		{Metric: model.Metric{"mountpoint": "/boot"}, Values: series(50, -1)},
+		// crossed the limit 2h ago, already at the limit
+		{Metric: model.Metric{"mountpoint": "/var"}, Values: series(102, 1)},
+		// above the limit for the whole range and still rising
+		{Metric: model.Metric{"mountpoint": "/home"}, Values: series(130, 1)},
+	}
+	loc := time.FixedZone("UTC+8", 8*3600)
+	vector := forecastSeries(matrix, now, loc, common.Forecast{Limit: 100}, 24*time.Hour)
+	if len(vector) != 3 {
+		t.Fatalf("forecastSeries() returned %d series, want 3", len(vector))
+	}
+	for i, mountpoint := range []model.LabelValue{"/var", "/home"} {
+		if full := vector[i+1]; full.Metric["mountpoint"] != mountpoint || full.Metric[common.TIMETOLIMITLABEL] != "0s" {
+			t.Errorf("forecastSeries() = %v, want %s at the limit", full, mountpoint)
+		}
+	}
+	// only /boot falls to the lower limit
+	down := forecastSeries(matrix, now, loc, common.Forecast{Limit: 40, Direction: DirectionDown}, 24*time.Hour)
+	if len(down) != 1 || down[0].Metric["mountpoint"] != "/boot" || down[0].Metric[common.TIMETOLIMITLABEL] != "10h" {
+		t.Errorf("forecastSeries() down = %v, want /boot in 10h", down)
+	}
+	s := vector[0]
+	if s.Metric["mountpoint"] != "/" {
+		t.Errorf("forecastSeries() mountpoint = %s, want /", s.Metric["mountpoint"])
+	}
+	if got := s.Metric[common.TIMETOLIMITLABEL]; got != "20h" {
+		t.Errorf("time to limit = %s, want 20h", got)
+	}
+	if got := s.Metric[common.TRENDLABEL]; got != "+24/d" {
+		t.Errorf("trend = %s, want +24/d", got)
+	}
+	if got, want := s.Metric[common.LIMITATLABEL], now.Add(20*time.Hour).Truncate(time.Minute).In(loc).Format(time.RFC3339); string(got) != want {
+		t.Errorf("limit at = %s, want %s", got, want)
+	}
+	if s.Value != 80 {
+		t.Errorf("value = %v, want 80", s.Value)
+	}
+}
@@ -0,0 +1,121 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/longxiucai/patrol-tools/pkg/clients"
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// DefaultHost is used when no host is given and prometheus can not be discovered
+	DefaultHost = "http://127.0.0.1:9090"
+	// KubeServiceScheme marks an address reached through the kube-apiserver services proxy,
+	// e.g. k8s://monitoring/prometheus-k8s:9090 or k8s://monitoring/https:prometheus-k8s:web
+	KubeServiceScheme = "k8s://"
+)
+
+// prometheusServiceSelectors are the common labels of prometheus services, in order of preference
+var prometheusServiceSelectors = []string{
+	"app.kubernetes.io/name=prometheus",
+	"app=kube-prometheus-stack-prometheus",
+	"app=prometheus",
+	"operated-prometheus=true",
+}
+
+// kubeService is a service reached through the kube-apiserver services proxy
+type kubeService struct {
+	Namespace string
+	// Name is the proxy name of the service, [scheme:]name[:port]
+	Name string
+}
+
+// parseKubeServiceAddress parses an address like k8s://<namespace>/[scheme:]<service>[:port]
+func parseKubeServiceAddress(address string) (kubeService, error) {
+	var svc kubeService
+	path := strings.TrimPrefix(address, KubeServiceScheme)
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return svc, fmt.Errorf("invalid kubernetes service address %s, expected %s<namespace>/<service>[:port]", address, KubeServiceScheme)
+	}
+	svc.Namespace = parts[0]
+	svc.Name = parts[1]
+	return svc, nil
+}
+
+// proxyURL returns the kube-apiserver services proxy url of the service
+func (s kubeService) proxyURL(host string) string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/services/%s/proxy", strings.TrimSuffix(host, "/"), s.Namespace, s.Name)
+}
+
+// kubeProxyTransport returns the services proxy url of the address and the transport of the kube rest config
+func kubeProxyTransport(address string, cb *clients.Builder) (string, http.RoundTripper, error) {
+	if cb == nil {
+		return "", nil, fmt.Errorf("kube client is required for %s, check the kubeconfig", address)
+	}
+	svc, err := parseKubeServiceAddress(address)
+	if err != nil {
+		return "", nil, err
+	}
+	restConfig := cb.GetBuilderConfig()
+	rt, err := rest.TransportFor(restConfig)
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating kube transport, %s", err)
+	}
+	host := svc.proxyURL(restConfig.Host)
+	glog.V(4).Infof("Using kube-apiserver services proxy %s", host)
+	return host, rt, nil
+}
+
+// DiscoverPrometheus looks up a prometheus service by its common labels
+// and returns its address through the kube-apiserver services proxy
+func DiscoverPrometheus(cb *clients.Builder) (string, error) {
+	if cb == nil {
+		return "", fmt.Errorf("kube client is required to discover prometheus, check the kubeconfig")
+	}
+	client := cb.KubeClientOrDie(common.NAME)
+	for _, selector := range prometheusServiceSelectors {
+		svcList, err := client.CoreV1().Services(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+			LabelSelector: selector,
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, svc := range svcList.Items {
+			port, ok := prometheusServicePort(svc)
+			if !ok {
+				continue
+			}
+			address := fmt.Sprintf("%s%s/%s:%s", KubeServiceScheme, svc.Namespace, svc.Name, port)
+			glog.Infof("Discovered prometheus service %s by label %s", address, selector)
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("no prometheus service found by labels %v", prometheusServiceSelectors)
+}
+
+// prometheusServicePort returns the web port of a prometheus service
+func prometheusServicePort(svc corev1.Service) (string, bool) {
+	for _, port := range svc.Spec.Ports {
+		if port.Name == "web" || port.Name == "http-web" || port.Port == 9090 {
+			return fmt.Sprintf("%d", port.Port), true
+		}
+	}
+	if len(svc.Spec.Ports) == 1 {
+		return fmt.Sprintf("%d", svc.Spec.Ports[0].Port), true
+	}
+	return "", false
+}
+
+// isKubeServiceAddress returns true if the address is reached through the kube-apiserver services proxy
+func isKubeServiceAddress(address string) bool {
+	return strings.HasPrefix(address, KubeServiceScheme)
+}
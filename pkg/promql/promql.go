@@ -4,13 +4,15 @@ package promql
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
 	"time"
 
+	"github.com/longxiucai/patrol-tools/pkg/clients"
 	"github.com/longxiucai/patrol-tools/pkg/common"
 	"github.com/longxiucai/patrol-tools/pkg/result"
+	"github.com/longxiucai/patrol-tools/pkg/util/timeexpr"
 
+	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/config"
@@ -37,77 +39,84 @@ type PromQL struct {
 	TLSConfig       config.TLSConfig
 	Rules           []common.Rule `mapstructure:"rules" yaml:"rules"`
 	KubeConfigPath  string        `mapstructure:"kubeconfig" yaml:"kubeconfig"`
+	Datasources     []Datasource  `mapstructure:"-" yaml:"datasources"`
+	HTTPConfig      *HTTPConfig   `mapstructure:"-" yaml:"http_config"`
+	KubeBuilder     *clients.Builder
+	// Record and Replay are the directories to record the responses of the datasources to, or to replay them from
+	Record   string `mapstructure:"record" yaml:"record"`
+	Replay   string `mapstructure:"replay" yaml:"replay"`
+	Recorder *Recorder
+	Replayer *Replayer
+	// Hosts is the hosts inventory, scraped by the scrape datasource
+	Hosts []common.Host `mapstructure:"-"`
+	// Now is the current time of the run, pinned to the recorded time when replaying
+	Now time.Time
+	// Timezone of the time expressions and of the rendered timestamps, empty is the local timezone
+	Timezone string         `mapstructure:"timezone" yaml:"timezone"`
+	Location *time.Location `mapstructure:"-"`
 }
 
-// CreateClientWithAuth creates a Client interface witht the provided hostname and auth config
-func CreateClientWithAuth(host string, authCfg config.Authorization, tlsCfg config.TLSConfig) (v1.API, error) {
-	cfg := api.Config{
-		Address: host,
-	}
-	tc, err := config.NewTLSConfig(&tlsCfg)
+// newRoundTripper creates the round tripper of the http client config
+func newRoundTripper(httpCfg HTTPConfig) (http.RoundTripper, error) {
+	rt, err := config.NewRoundTripperFromConfig(httpCfg.HTTPClientConfig, common.NAME)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing TLS config, %s", err)
-	}
-	var rt http.RoundTripper = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		TLSHandshakeTimeout: 10 * time.Second,
-		TLSClientConfig:     tc,
+		return nil, fmt.Errorf("error creating http round tripper, %s", err)
 	}
+	return rt, nil
+}
 
-	if authCfg != (config.Authorization{}) {
-		switch {
-		case authCfg.Type == "":
-			return nil, fmt.Errorf("please specify an authentication type, run promql --help for more details")
-		case authCfg.Credentials != "" && authCfg.CredentialsFile != "":
-			return nil, fmt.Errorf("please specify either auth credentials or an auth credential file, not both")
-		case authCfg.Credentials != "":
-			rt = config.NewAuthorizationCredentialsRoundTripper(authCfg.Type, config.Secret(authCfg.Credentials), rt)
-		default:
-			rt = config.NewAuthorizationCredentialsFileRoundTripper(authCfg.Type, authCfg.CredentialsFile, rt)
+// newAPI creates a Client interface on top of the round tripper,
+// adding the headers and redirect policy of the http client config
+func newAPI(host string, rt http.RoundTripper, httpCfg HTTPConfig) (v1.API, error) {
+	if len(httpCfg.Headers) > 0 {
+		rt = &headersRoundTripper{headers: httpCfg.Headers, rt: rt}
+	}
+	client := &http.Client{Transport: rt}
+	if !httpCfg.HTTPClientConfig.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
 		}
 	}
-	cfg.RoundTripper = rt
-	a, err := api.NewClient(cfg)
+	a, err := api.NewClient(api.Config{
+		Address: host,
+		Client:  client,
+	})
 	if err != nil {
 		return nil, err
 	}
 	return v1.NewAPI(a), nil
 }
 
-// InstantQuery performs an instant query and returns the result
+// Run evaluates every rule against its datasources and returns the results.
+// If a datasource fails and has a fallback, the rule is evaluated against the fallback
+// and the result is marked as degraded.
 func (p *PromQL) Run() (result.ResultList, v1.Warnings, error) {
 	var results result.ResultList
-	if p.Start != "" {
-		for _, rule := range p.Rules {
-			matrixResult, warnings, err := p.rangeQuery(rule.Expr)
-			if len(warnings) > 0 {
-				return nil, warnings, nil
-			}
-			if err != nil {
-				return nil, nil, err
-			}
-			result := result.Result{
-				Rule:       rule,
-				PromResult: matrixResult,
-			}
-			results = append(results, result)
+	for _, rule := range p.Rules {
+		dsList, err := p.GetDatasources(rule)
+		if err != nil {
+			return nil, nil, err
 		}
-	} else {
-		for _, rule := range p.Rules {
-			vectorResult, warnings, err := p.instantQuery(rule.Expr)
+		for _, ds := range dsList {
+			dsName := ds.Name
+			promResult, warnings, err := p.query(ds.Client, rule)
+			if err != nil && ds.Fallback != "" {
+				fallback := p.getDatasource(ds.Fallback)
+				glog.Warningf("Datasource %s: %v, evaluating rule %s against the fallback datasource %s", ds.Name, err, rule.Name, fallback.Name)
+				promResult, warnings, err = p.query(fallback.Client, rule)
+				promResult = markDegraded(promResult, fallback.Name)
+				dsName = fmt.Sprintf("%s (degraded: %s)", ds.Name, fallback.Name)
+			}
 			if len(warnings) > 0 {
 				return nil, warnings, nil
 			}
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, fmt.Errorf("datasource %s: %v", dsName, err)
 			}
 			result := result.Result{
 				Rule:       rule,
-				PromResult: vectorResult,
+				Datasource: dsName,
+				PromResult: promResult,
 			}
 			results = append(results, result)
 		}
@@ -115,12 +124,79 @@ func (p *PromQL) Run() (result.ResultList, v1.Warnings, error) {
 	return results, nil, nil
 }
 
+// query evaluates the rule as a range query if the start flag is set,
+// against its baseline if it is an anomaly rule, by its trend if it is a forecast rule,
+// over its for duration if set, or else as an instant query
+func (p *PromQL) query(client v1.API, rule common.Rule) (interface{}, v1.Warnings, error) {
+	if p.Start != "" {
+		return p.rangeQuery(client, rule.Expr)
+	}
+	if rule.Anomaly != nil {
+		return p.anomalyQuery(client, rule)
+	}
+	if rule.Forecast != nil {
+		return p.forecastQuery(client, rule)
+	}
+	if rule.For != "" {
+		return p.forQuery(client, rule)
+	}
+	return p.instantQuery(client, rule.Expr)
+}
+
+// Evaluate evaluates the rule again at the current time against its datasources, for the verification of the recovery.
+// Like the patrol run, anomaly, forecast and for rules are evaluated by their own queries. The results of the
+// datasources are merged.
+func (p *PromQL) Evaluate(rule common.Rule) (interface{}, error) {
+	dsList, err := p.GetDatasources(rule)
+	if err != nil {
+		return nil, err
+	}
+	q := *p
+	q.Time = time.Now()
+	if p.Location != nil {
+		q.Time = q.Time.In(p.Location)
+	}
+	var vector model.Vector
+	var matrix model.Matrix
+	for _, ds := range dsList {
+		result, warnings, err := q.query(ds.Client, rule)
+		if err != nil && ds.Fallback != "" {
+			fallback := p.getDatasource(ds.Fallback)
+			glog.Warningf("Datasource %s: %v, evaluating rule %s against the fallback datasource %s", ds.Name, err, rule.Name, fallback.Name)
+			result, warnings, err = q.query(fallback.Client, rule)
+		}
+		if len(warnings) > 0 {
+			glog.Warningf("Warnings: %v", warnings)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("datasource %s: %v", ds.Name, err)
+		}
+		switch r := result.(type) {
+		case model.Vector:
+			vector = append(vector, r...)
+		case model.Matrix:
+			matrix = append(matrix, r...)
+		default:
+			return nil, fmt.Errorf("datasource %s: unsupported result type: %v", ds.Name, r)
+		}
+	}
+	if p.Start != "" {
+		return matrix, nil
+	}
+	return vector, nil
+}
+
 // InstantQuery performs an instant query and returns the result
-func (p *PromQL) instantQuery(queryString string) (model.Vector, v1.Warnings, error) {
+func (p *PromQL) instantQuery(client v1.API, queryString string) (model.Vector, v1.Warnings, error) {
+	return p.instantQueryAt(client, queryString, p.Time)
+}
+
+// instantQueryAt performs an instant query at the time
+func (p *PromQL) instantQueryAt(client v1.API, queryString string, t time.Time) (model.Vector, v1.Warnings, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), p.TimeoutDuration)
 	defer cancel()
 
-	result, warnings, err := p.Client.Query(ctx, queryString, p.Time)
+	result, warnings, err := client.Query(ctx, queryString, t)
 	if err != nil {
 		return nil, warnings, fmt.Errorf("error querying prometheus: %v", err)
 	}
@@ -132,22 +208,27 @@ func (p *PromQL) instantQuery(queryString string) (model.Vector, v1.Warnings, er
 	}
 }
 
-func parseRangeStart(s string) (time.Time, error) {
-	if t, err := time.Parse(time.RFC3339, s); err == nil {
-		return t, nil
-	} else if d, err := time.ParseDuration(s); err == nil {
-		return time.Now().Add(-d), nil
-	} else {
-		err = fmt.Errorf("unable to parse range start time, %v", err)
-		return time.Time{}, err
+// now returns the pinned current time of a replayed run, or the current time in the timezone
+func (p *PromQL) now() time.Time {
+	if !p.Now.IsZero() {
+		return p.Now
+	}
+	if p.Location != nil {
+		return time.Now().In(p.Location)
 	}
+	return time.Now()
 }
 
-func parseRangeEnd(e string) (time.Time, error) {
-	if e == "now" {
-		return time.Now(), nil
+func parseRangeStart(s string, now time.Time) (time.Time, error) {
+	t, err := timeexpr.Parse(s, now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse range start time, %v", err)
 	}
-	t, err := time.Parse(time.RFC3339, e)
+	return t, nil
+}
+
+func parseRangeEnd(e string, now time.Time) (time.Time, error) {
+	t, err := timeexpr.Parse(e, now)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("error parsing range end time, %v", err)
 	}
@@ -157,70 +238,43 @@ func parseRangeEnd(e string) (time.Time, error) {
 // getRange creates a prometheus range from the provided start, end, and step options
 func (p *PromQL) getRange() (r v1.Range, err error) {
 	// At minimum we need a start time so we attempt to parse that first
-	r.Start, err = parseRangeStart(p.Start)
+	r.Start, err = parseRangeStart(p.Start, p.now())
 	if err != nil {
 		return r, err
 	}
-	// Set up defaults for the step value
-	r.Step = time.Minute
-	// If the user provided a step value, parse it as a time.Duration and override the default
-	if p.Step != "" {
-		r.Step, err = time.ParseDuration(p.Step)
-		if err != nil {
-			err = fmt.Errorf("unable to parse step duration, %v", err)
-			return r, err
-		}
-	}
-
 	// If the user provided an end value, parse it to a time struct and override the default
-	r.End, err = parseRangeEnd(p.End)
+	r.End, err = parseRangeEnd(p.End, p.now())
 	if err != nil {
 		return r, err
 	}
-
+	// An empty or auto step is selected from the length of the range
+	r.Step, err = parseStep(p.Step, r.End.Sub(r.Start))
 	return r, err
 }
 
-// rangeQuery performs a range query and writes the results to stdout
-func (p *PromQL) rangeQuery(queryString string) (model.Matrix, v1.Warnings, error) {
-	// create context with a timeout,
-	ctx, cancel := context.WithTimeout(context.Background(), p.TimeoutDuration)
-	defer cancel()
-
+// rangeQuery performs a range query over the range of the start, end and step options
+func (p *PromQL) rangeQuery(client v1.API, queryString string) (model.Matrix, v1.Warnings, error) {
 	r, err := p.getRange()
 	if err != nil {
 		return nil, nil, err
 	}
-	// execute query
-	result, warnings, err := p.Client.QueryRange(ctx, queryString, r)
-	if err != nil {
-		return nil, warnings, err
-	}
-
-	if result, ok := result.(model.Matrix); ok {
-		return result, warnings, err
-	} else {
-		return nil, warnings, fmt.Errorf("did not receive a range result")
-	}
+	return p.queryRange(client, queryString, r)
 }
 
-// LabelsQuery runs a labels query and returns the result
-func (p *PromQL) LabelsQuery(query string) (model.Vector, v1.Warnings, error) {
+// LabelsQuery returns the values of a label for the series matching the selectors
+func (p *PromQL) LabelsQuery(label string, matches []string) (model.LabelValues, v1.Warnings, error) {
+	s, e, err := p.getSeriesRange()
+	if err != nil {
+		return nil, nil, err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), p.TimeoutDuration)
 	defer cancel()
 
-	result, warnings, err := p.Client.Query(ctx, query, time.Now())
+	result, warnings, err := p.Client.LabelValues(ctx, label, matches, s, e)
 	if err != nil {
-		return nil, warnings, err
-	}
-
-	// if result is the expected type, Write it out in the
-	// desired output format
-	if result, ok := result.(model.Vector); ok {
-		return result, warnings, err
-	} else {
-		return nil, warnings, fmt.Errorf("did not recieve an instant vector")
+		return nil, warnings, fmt.Errorf("error querying label values endpoint: %v", err)
 	}
+	return result, warnings, nil
 }
 
 // MetaQuery returns prometheus metrics metadata. Used for our metrics and meta commands
@@ -235,26 +289,34 @@ func (p *PromQL) MetaQuery(query string) (map[string][]v1.Metadata, error) {
 	return result, nil
 }
 
-// SeriesQuery returns prometheus series data
-func (p *PromQL) SeriesQuery(query string) ([]model.LabelSet, v1.Warnings, error) {
-	// Set defaults based on time flag
+// getSeriesRange returns the time range of series and label values queries.
+// It defaults to the 15 seconds before the time flag, and is overridden by the start and end flags.
+func (p *PromQL) getSeriesRange() (time.Time, time.Time, error) {
 	s := p.Time.Add(-15 * time.Second)
 	e := p.Time
-	// Parse range start and end if provided and override the defaults
 	if p.Start != "" {
 		var err error
-		s, err = parseRangeStart(p.Start)
+		s, err = parseRangeStart(p.Start, p.now())
 		if err != nil {
-			return []model.LabelSet{}, v1.Warnings{}, err
+			return s, e, err
 		}
-	}
-	if p.End != "" {
-		var err error
-		e, err = parseRangeEnd(p.End)
-		if err != nil {
-			return []model.LabelSet{}, v1.Warnings{}, err
+		// the end flag defaults to now, so it is only used together with start
+		if p.End != "" {
+			e, err = parseRangeEnd(p.End, p.now())
+			if err != nil {
+				return s, e, err
+			}
 		}
 	}
+	return s, e, nil
+}
+
+// SeriesQuery returns prometheus series data
+func (p *PromQL) SeriesQuery(query string) ([]model.LabelSet, v1.Warnings, error) {
+	s, e, err := p.getSeriesRange()
+	if err != nil {
+		return []model.LabelSet{}, v1.Warnings{}, err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), p.TimeoutDuration)
 	defer cancel()
 	result, warnings, err := p.Client.Series(ctx, []string{query}, s, e)
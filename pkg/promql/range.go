@@ -0,0 +1,214 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// AutoStep selects the step from the length of the range, it is used when the step is not set
+	AutoStep = "auto"
+	// maxPoints is the limit of points per series of a prometheus range query
+	maxPoints = 11000
+	// chunkPoints is the points per series of every chunk of a long range query, under the prometheus limit
+	chunkPoints = 10000
+	// maxConcurrentChunks is the number of chunks queried at the same time
+	maxConcurrentChunks = 4
+)
+
+// autoSteps are the steps chosen by the auto step, from the smallest
+var autoSteps = []time.Duration{
+	time.Minute,
+	2 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+}
+
+// parseStep parses the step of a range, an empty or auto step is selected from the range length
+func parseStep(step string, length time.Duration) (time.Duration, error) {
+	if step == "" || step == AutoStep {
+		return autoStep(length), nil
+	}
+	d, err := time.ParseDuration(step)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse step duration, %v", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("step duration must be positive, got %s", step)
+	}
+	return d, nil
+}
+
+// autoStep returns the smallest step of at least 1m which keeps the range under the prometheus point limit,
+// so that the range is queried in one request
+func autoStep(length time.Duration) time.Duration {
+	for _, step := range autoSteps {
+		if points(length, step) <= maxPoints {
+			return step
+		}
+	}
+	day := autoSteps[len(autoSteps)-1]
+	days := (length/maxPoints + day - 1) / day
+	return days * day
+}
+
+// points returns the number of points per series of a range
+func points(length, step time.Duration) int64 {
+	return int64(length/step) + 1
+}
+
+// splitRange splits the range into chunks of at most chunkPoints points.
+// The chunks are aligned on the steps of the range and do not overlap.
+func splitRange(r v1.Range) []v1.Range {
+	if points(r.End.Sub(r.Start), r.Step) <= chunkPoints {
+		return []v1.Range{r}
+	}
+	var chunks []v1.Range
+	chunkLength := time.Duration(chunkPoints-1) * r.Step
+	for start := r.Start; !start.After(r.End); start = start.Add(chunkLength + r.Step) {
+		end := start.Add(chunkLength)
+		if end.After(r.End) {
+			end = r.End
+		}
+		chunks = append(chunks, v1.Range{Start: start, End: end, Step: r.Step})
+	}
+	return chunks
+}
+
+// queryRange performs a range query over the provided range and returns the result.
+// Ranges over the point limit of prometheus are split into chunks, queried concurrently and merged.
+func (p *PromQL) queryRange(client v1.API, queryString string, r v1.Range) (model.Matrix, v1.Warnings, error) {
+	chunks := splitRange(r)
+	if len(chunks) == 1 {
+		return p.queryRangeOnce(client, queryString, r)
+	}
+	glog.V(4).Infof("Splitting range query %s from %s to %s into %d chunks", queryString, r.Start, r.End, len(chunks))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		warnings v1.Warnings
+		sem      = make(chan struct{}, maxConcurrentChunks)
+		parts    = make([]model.Matrix, len(chunks))
+	)
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk v1.Range) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			mu.Lock()
+			failed := firstErr != nil
+			mu.Unlock()
+			if failed {
+				return
+			}
+			matrix, w, err := p.queryRangeOnce(client, queryString, chunk)
+			mu.Lock()
+			defer mu.Unlock()
+			warnings = append(warnings, w...)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("range chunk %s to %s: %v", chunk.Start.Format(time.RFC3339), chunk.End.Format(time.RFC3339), err)
+				}
+				return
+			}
+			parts[i] = matrix
+		}(i, chunk)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, warnings, firstErr
+	}
+	return mergeMatrix(parts...), warnings, nil
+}
+
+// queryRangeOnce performs a single range query request
+func (p *PromQL) queryRangeOnce(client v1.API, queryString string, r v1.Range) (model.Matrix, v1.Warnings, error) {
+	// create context with a timeout,
+	ctx, cancel := context.WithTimeout(context.Background(), p.TimeoutDuration)
+	defer cancel()
+
+	// execute query
+	result, warnings, err := client.QueryRange(ctx, queryString, r)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	if result, ok := result.(model.Matrix); ok {
+		return result, warnings, err
+	} else {
+		return nil, warnings, fmt.Errorf("did not receive a range result")
+	}
+}
+
+// mergeMatrix merges the matrices of the chunks of a range per series.
+// The samples are sorted by timestamp and a sample at the same timestamp is kept once.
+func mergeMatrix(parts ...model.Matrix) model.Matrix {
+	streams := make(map[model.Fingerprint]*model.SampleStream)
+	var merged model.Matrix
+	for _, part := range parts {
+		for _, s := range part {
+			fp := s.Metric.Fingerprint()
+			stream, ok := streams[fp]
+			if !ok {
+				stream = &model.SampleStream{Metric: s.Metric}
+				streams[fp] = stream
+				merged = append(merged, stream)
+			}
+			stream.Values = append(stream.Values, s.Values...)
+			stream.Histograms = append(stream.Histograms, s.Histograms...)
+		}
+	}
+	for _, stream := range merged {
+		stream.Values = dedupeValues(stream.Values)
+		stream.Histograms = dedupeHistograms(stream.Histograms)
+	}
+	sort.Sort(merged)
+	return merged
+}
+
+func dedupeValues(values []model.SamplePair) []model.SamplePair {
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Timestamp < values[j].Timestamp
+	})
+	result := values[:0]
+	for _, v := range values {
+		if len(result) > 0 && v.Timestamp == result[len(result)-1].Timestamp {
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+func dedupeHistograms(histograms []model.SampleHistogramPair) []model.SampleHistogramPair {
+	sort.SliceStable(histograms, func(i, j int) bool {
+		return histograms[i].Timestamp < histograms[j].Timestamp
+	})
+	result := histograms[:0]
+	for _, h := range histograms {
+		if len(result) > 0 && h.Timestamp == result[len(result)-1].Timestamp {
+			continue
+		}
+		result = append(result, h)
+	}
+	return result
+}
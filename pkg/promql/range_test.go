@@ -0,0 +1,94 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestSplitRange(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := v1.Range{
+		Start: start,
+		End:   start.Add(30 * 24 * time.Hour),
+		Step:  time.Minute,
+	}
+	chunks := splitRange(r)
+	if len(chunks) != 5 {
+		t.Fatalf("splitRange() returned %d chunks, want 5", len(chunks))
+	}
+	if !chunks[0].Start.Equal(r.Start) || !chunks[len(chunks)-1].End.Equal(r.End) {
+		t.Errorf("splitRange() chunks do not cover the range")
+	}
+	for i, chunk := range chunks {
+		if n := points(chunk.End.Sub(chunk.Start), chunk.Step); n > chunkPoints {
+			t.Errorf("chunk %d has %d points, want at most %d", i, n, chunkPoints)
+		}
+		if i > 0 && !chunk.Start.Equal(chunks[i-1].End.Add(r.Step)) {
+			t.Errorf("chunk %d starts at %v, want the step after %v", i, chunk.Start, chunks[i-1].End)
+		}
+	}
+}
+
+func TestMergeMatrix(t *testing.T) {
+	values := func(timestamps ...int64) []model.SamplePair {
+		var result []model.SamplePair
+		for _, ts := range timestamps {
+			result = append(result, model.SamplePair{Timestamp: model.Time(ts), Value: model.SampleValue(ts)})
+		}
+		return result
+	}
+	merged := mergeMatrix(
+		model.Matrix{
+			{Metric: model.Metric{"pod": "b"}, Values: values(1, 2, 3)},
+			{Metric: model.Metric{"pod": "a"}, Values: values(1, 2)},
+		},
+		model.Matrix{
+			{Metric: model.Metric{"pod": "b"}, Values: values(3, 4)},
+			{Metric: model.Metric{"pod": "c"}, Values: values(4)},
+		},
+	)
+	want := map[model.LabelValue][]model.SamplePair{
+		"a": values(1, 2),
+		"b": values(1, 2, 3, 4),
+		"c": values(4),
+	}
+	if len(merged) != len(want) {
+		t.Fatalf("mergeMatrix() returned %d series, want %d", len(merged), len(want))
+	}
+	for i, pod := range []model.LabelValue{"a", "b", "c"} {
+		s := merged[i]
+		if s.Metric["pod"] != pod {
+			t.Errorf("series %d is pod %s, want %s", i, s.Metric["pod"], pod)
+			continue
+		}
+		if len(s.Values) != len(want[pod]) {
+			t.Errorf("pod %s values = %v, want %v", pod, s.Values, want[pod])
+			continue
+		}
+		for j := range s.Values {
+			if !s.Values[j].Equal(&want[pod][j]) {
+				t.Errorf("pod %s values = %v, want %v", pod, s.Values, want[pod])
+				break
+			}
+		}
+	}
+}
+
+func TestAutoStep(t *testing.T) {
+	for _, tc := range []struct {
+		length time.Duration
+		want   time.Duration
+	}{
+		{time.Hour, time.Minute},
+		{7 * 24 * time.Hour, time.Minute},
+		{30 * 24 * time.Hour, 5 * time.Minute},
+		{365 * 24 * time.Hour, time.Hour},
+	} {
+		if got := autoStep(tc.length); got != tc.want {
+			t.Errorf("autoStep(%s) = %s, want %s", tc.length, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package promql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// ManifestFile is the file in the record directory that lists the recorded requests
+const ManifestFile = "manifest.json"
+
+// Manifest pins the time of the recorded run and lists its requests
+type Manifest struct {
+	// Now is the current time of the recorded run, used by relative ranges like --start 1h
+	Now time.Time `json:"now"`
+	// Time is the time of the instant queries
+	Time    time.Time `json:"time"`
+	Entries []Entry   `json:"entries"`
+}
+
+// Entry is a recorded request and its raw response
+type Entry struct {
+	Datasource string     `json:"datasource"`
+	Path       string     `json:"path"`
+	Params     url.Values `json:"params"`
+	StatusCode int        `json:"status_code,omitempty"`
+	// Error is the error of a request without response
+	Error string `json:"error,omitempty"`
+	// File is the response body file, relative to the record directory
+	File string `json:"file,omitempty"`
+}
+
+func (e Entry) key() string {
+	return requestKey(e.Datasource, e.Path, e.Params)
+}
+
+func requestKey(datasource, apiPath string, params url.Values) string {
+	return datasource + " " + apiPath + "?" + params.Encode()
+}
+
+// apiPath returns the path of the request from the prometheus api prefix,
+// so that the proxy prefix of the kube-apiserver is not part of the key
+func apiPath(u *url.URL) string {
+	if i := strings.Index(u.Path, "/api/v1/"); i >= 0 {
+		return u.Path[i:]
+	}
+	return u.Path
+}
+
+// requestParams returns the query and form parameters of the request without consuming its body
+func requestParams(req *http.Request) (url.Values, error) {
+	params := req.URL.Query()
+	if req.Body == nil || req.GetBody == nil {
+		return params, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(content))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range form {
+		params[k] = append(params[k], v...)
+	}
+	return params, nil
+}
+
+// Recorder saves every request to the datasources and its raw response into a directory
+type Recorder struct {
+	Dir      string
+	mu       sync.Mutex
+	manifest Manifest
+}
+
+// NewRecorder creates the record directory, now and t are saved to be pinned on replay
+func NewRecorder(dir string, now, t time.Time) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		Dir:      dir,
+		manifest: Manifest{Now: now, Time: t},
+	}
+	return r, r.save()
+}
+
+// RoundTripper returns a round tripper which records the requests of the datasource
+func (r *Recorder) RoundTripper(datasource string, rt http.RoundTripper) http.RoundTripper {
+	return &recordRoundTripper{recorder: r, datasource: datasource, rt: rt}
+}
+
+// add saves the response body and rewrites the manifest, so that the record is usable even if patrol dies
+func (r *Recorder) add(entry Entry, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if body != nil {
+		entry.File = fmt.Sprintf("%04d.json", len(r.manifest.Entries))
+		if err := ioutil.WriteFile(filepath.Join(r.Dir, entry.File), body, 0644); err != nil {
+			return err
+		}
+	}
+	r.manifest.Entries = append(r.manifest.Entries, entry)
+	return r.save()
+}
+
+func (r *Recorder) save() error {
+	content, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.Dir, ManifestFile), content, 0644)
+}
+
+type recordRoundTripper struct {
+	recorder   *Recorder
+	datasource string
+	rt         http.RoundTripper
+}
+
+func (t *recordRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	params, err := requestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	entry := Entry{
+		Datasource: t.datasource,
+		Path:       apiPath(req.URL),
+		Params:     params,
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+		if recErr := t.recorder.add(entry, nil); recErr != nil {
+			return nil, fmt.Errorf("record error: %v", recErr)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	entry.StatusCode = resp.StatusCode
+	if err := t.recorder.add(entry, body); err != nil {
+		return nil, fmt.Errorf("record error: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// Replayer serves the recorded responses instead of the datasources
+type Replayer struct {
+	Dir      string
+	Manifest Manifest
+	mu       sync.Mutex
+	// entries are the recorded entries of every request, served in order
+	entries map[string][]Entry
+}
+
+// NewReplayer loads the manifest of the record directory
+func NewReplayer(dir string) (*Replayer, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	r := &Replayer{Dir: dir, entries: make(map[string][]Entry)}
+	if err := json.Unmarshal(content, &r.Manifest); err != nil {
+		return nil, fmt.Errorf("record manifest %s: %v", dir, err)
+	}
+	for _, e := range r.Manifest.Entries {
+		r.entries[e.key()] = append(r.entries[e.key()], e)
+	}
+	return r, nil
+}
+
+// Client returns a v1.API which serves the recorded responses of the datasource
+func (r *Replayer) Client(datasource string) v1.API {
+	return v1.NewAPI(&replayClient{replayer: r, datasource: datasource})
+}
+
+// next returns the next recorded entry of the request, the last one is repeated
+func (r *Replayer) next(key string) (Entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := r.entries[key]
+	if len(entries) == 0 {
+		return Entry{}, false
+	}
+	if len(entries) > 1 {
+		r.entries[key] = entries[1:]
+	}
+	return entries[0], true
+}
+
+// replayClient implements api.Client on top of the recorded responses
+type replayClient struct {
+	replayer   *Replayer
+	datasource string
+}
+
+var _ api.Client = &replayClient{}
+
+func (c *replayClient) URL(ep string, args map[string]string) *url.URL {
+	p := path.Join("/", ep)
+	for arg, val := range args {
+		p = strings.ReplaceAll(p, ":"+arg, val)
+	}
+	return &url.URL{Scheme: "http", Host: "replay", Path: p}
+}
+
+func (c *replayClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	params, err := requestParams(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := requestKey(c.datasource, apiPath(req.URL), params)
+	entry, ok := c.replayer.next(key)
+	if !ok {
+		return nil, nil, fmt.Errorf("replay %s: no recorded response for %s", c.replayer.Dir, key)
+	}
+	if entry.Error != "" {
+		return nil, nil, fmt.Errorf("%s", entry.Error)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(c.replayer.Dir, entry.File))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp := &http.Response{
+		StatusCode: entry.StatusCode,
+		Status:     fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+	return resp, body, nil
+}
@@ -0,0 +1,215 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/engine"
+
+	"github.com/golang/glog"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ScrapeDatasource scrapes the exporters directly and evaluates the rules in process,
+// e.g. as the fallback of a prometheus datasource when prometheus is down
+const ScrapeDatasource = "scrape"
+
+const scrapeAcceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// ScrapeConfig lists the exporters of the scrape datasource
+type ScrapeConfig struct {
+	Targets []ScrapeTarget `yaml:"targets,omitempty"`
+	// Inventory scrapes an exporter on every host of the hosts inventory
+	Inventory []InventoryTarget `yaml:"inventory,omitempty"`
+}
+
+// ScrapeTarget is an exporter url, e.g. http://kube-state-metrics.kube-system:8080/metrics
+type ScrapeTarget struct {
+	URL string `yaml:"url"`
+	// Labels are added to the samples, instance and job default to the host of the url and the datasource name
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// InventoryTarget is an exporter running on the inventory hosts, e.g. node_exporter on port 9100
+type InventoryTarget struct {
+	Scheme string `yaml:"scheme,omitempty"`
+	Port   int    `yaml:"port"`
+	Path   string `yaml:"path,omitempty"`
+	// Roles selects the hosts with one of the roles, all hosts if empty
+	Roles  []string          `yaml:"roles,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// targets returns the scrape targets of the config and of the inventory hosts
+func (c ScrapeConfig) targets(hosts []common.Host) []ScrapeTarget {
+	targets := append([]ScrapeTarget(nil), c.Targets...)
+	for _, it := range c.Inventory {
+		scheme, path := it.Scheme, it.Path
+		if scheme == "" {
+			scheme = "http"
+		}
+		if path == "" {
+			path = "/metrics"
+		}
+		for _, host := range hosts {
+			if len(it.Roles) > 0 && !hasRole(host, it.Roles) {
+				continue
+			}
+			for _, ip := range host.IPS {
+				u := url.URL{Scheme: scheme, Host: net.JoinHostPort(ip.String(), strconv.Itoa(it.Port)), Path: path}
+				targets = append(targets, ScrapeTarget{URL: u.String(), Labels: it.Labels})
+			}
+		}
+	}
+	return targets
+}
+
+func hasRole(host common.Host, roles []string) bool {
+	for _, r := range host.Roles {
+		for _, role := range roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// createScrapeClient returns a client which scrapes the targets on its first query,
+// so the exporters are only scraped when the datasource is used
+func (p *PromQL) createScrapeClient(ds *Datasource) (v1.API, error) {
+	rt, err := newRoundTripper(ds.HTTPConfig)
+	if err != nil {
+		return nil, err
+	}
+	targets := ds.Scrape.targets(p.Hosts)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no scrape targets, check the targets, inventory and hosts")
+	}
+	client := &http.Client{Transport: rt}
+	return &lazyAPI{load: func() v1.API {
+		m := engine.NewMemory()
+		p.scrapeTargets(ds.Name, client, targets, m)
+		return engine.NewAPI(engine.NewEngine(p.TimeoutDuration), m)
+	}}, nil
+}
+
+// scrapeTargets scrapes the targets concurrently into the memory storage.
+// Like prometheus an up series is added for every target.
+func (p *PromQL) scrapeTargets(datasource string, client *http.Client, targets []ScrapeTarget, m *engine.Memory) {
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target ScrapeTarget) {
+			defer wg.Done()
+			targetLabels := map[string]string{
+				"job": datasource,
+			}
+			if u, err := url.Parse(target.URL); err == nil {
+				targetLabels["instance"] = u.Host
+			}
+			for k, v := range target.Labels {
+				targetLabels[k] = v
+			}
+
+			up := 1.0
+			n, err := p.scrape(client, target.URL, targetLabels, m)
+			if err != nil {
+				glog.Warningf("Datasource %s: scrape %s error: %v", datasource, target.URL, err)
+				up = 0
+			} else {
+				glog.V(4).Infof("Datasource %s: scraped %d samples from %s", datasource, n, target.URL)
+			}
+			upLabels := labels.FromMap(targetLabels)
+			upLabels = labels.NewBuilder(upLabels).Set(labels.MetricName, "up").Labels()
+			m.Add(upLabels, p.Time.UnixMilli(), up)
+		}(target)
+	}
+	wg.Wait()
+	glog.Infof("Datasource %s: scraped %d targets, loaded %d series", datasource, len(targets), m.Len())
+}
+
+func (p *PromQL) scrape(client *http.Client, target string, targetLabels map[string]string, m *engine.Memory) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.TimeoutDuration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", scrapeAcceptHeader)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return m.LoadExposition(content, p.Time, targetLabels)
+}
+
+// lazyAPI creates the client on its first query
+type lazyAPI struct {
+	v1.API
+	once   sync.Once
+	load   func() v1.API
+	client v1.API
+}
+
+func (l *lazyAPI) get() v1.API {
+	l.once.Do(func() {
+		l.client = l.load()
+	})
+	return l.client
+}
+
+func (l *lazyAPI) Query(ctx context.Context, query string, ts time.Time, opts ...v1.Option) (model.Value, v1.Warnings, error) {
+	return l.get().Query(ctx, query, ts, opts...)
+}
+
+func (l *lazyAPI) QueryRange(ctx context.Context, query string, r v1.Range, opts ...v1.Option) (model.Value, v1.Warnings, error) {
+	return l.get().QueryRange(ctx, query, r, opts...)
+}
+
+func (l *lazyAPI) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, v1.Warnings, error) {
+	return l.get().Series(ctx, matches, startTime, endTime)
+}
+
+func (l *lazyAPI) LabelValues(ctx context.Context, label string, matches []string, startTime, endTime time.Time) (model.LabelValues, v1.Warnings, error) {
+	return l.get().LabelValues(ctx, label, matches, startTime, endTime)
+}
+
+func (l *lazyAPI) Metadata(ctx context.Context, metric, limit string) (map[string][]v1.Metadata, error) {
+	return l.get().Metadata(ctx, metric, limit)
+}
+
+// markDegraded adds the degraded label with the fallback datasource to every series of the result
+func markDegraded(promResult interface{}, fallback string) interface{} {
+	switch r := promResult.(type) {
+	case model.Vector:
+		for _, s := range r {
+			s.Metric = s.Metric.Clone()
+			s.Metric[common.DEGRADEDLABEL] = model.LabelValue(fallback)
+		}
+	case model.Matrix:
+		for _, s := range r {
+			s.Metric = s.Metric.Clone()
+			s.Metric[common.DEGRADEDLABEL] = model.LabelValue(fallback)
+		}
+	}
+	return promResult
+}
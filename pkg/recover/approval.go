@@ -0,0 +1,286 @@
+package recover
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/util/hash"
+
+	"github.com/golang/glog"
+	"golang.org/x/term"
+	"k8s.io/client-go/kubernetes"
+)
+
+// approval status
+const (
+	PENDING  = "pending"
+	APPROVED = "approved"
+	REJECTED = "rejected"
+)
+
+// approvalKey is the key of the approvals in the data of the ConfigMap
+const approvalKey = "approvals.json"
+
+// ApprovalConfig requires a human to approve every recovery step.
+// On a TTY the steps are prompted, unattended runs write them to the file or the ConfigMap as pending
+// and only execute the steps marked as approved.
+type ApprovalConfig struct {
+	Enable      bool `yaml:"enable"`
+	StoreConfig `yaml:",inline"`
+}
+
+// Approval is a recovery step waiting for or given an approval
+type Approval struct {
+	ID      string    `json:"id"`
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Step    Step      `json:"step"`
+}
+
+// ApprovalStore keeps the approvals between unattended runs
+type ApprovalStore interface {
+	Load() ([]Approval, error)
+	Save([]Approval) error
+}
+
+// ID identifies the step across runs by its rule, target and command
+func (s Step) ID() string {
+	key := strings.Join([]string{s.Rule, s.Type, s.Action, s.Namespace, s.Pod, s.Service, s.Operation, s.Command}, "|")
+	return hash.MD5([]byte(key))[:12]
+}
+
+// Store returns the store of the file or the ConfigMap, nil if none is configured
+func (c ApprovalConfig) Store(client kubernetes.Interface) (ApprovalStore, error) {
+	store, err := c.open(client, approvalKey)
+	if store == nil || err != nil {
+		return nil, err
+	}
+	return approvalStore{store: store, source: c.source()}, nil
+}
+
+// Approve returns the plan with only the approved runnable steps. On a TTY every step is prompted,
+// otherwise the new steps are saved as pending into the store and the approved ones are returned.
+// Steps skipped by the limits or with an error are not approved, they are kept to be reported by Execute.
+func (c ApprovalConfig) Approve(plan Plan, client kubernetes.Interface, in *os.File, out io.Writer) (Plan, error) {
+	if !c.Enable {
+		return plan, nil
+	}
+	runnable := Plan{Created: plan.Created}
+	for _, step := range plan.Steps {
+		if step.Skip == "" && step.Error == "" {
+			runnable.Steps = append(runnable.Steps, step)
+		}
+	}
+	if len(runnable.Steps) == 0 {
+		return plan, nil
+	}
+	if term.IsTerminal(int(in.Fd())) {
+		approved, err := promptApproval(runnable, in, out)
+		return withApproved(plan, approved), err
+	}
+	store, err := c.Store(client)
+	if err != nil {
+		return Plan{}, err
+	}
+	if store == nil {
+		glog.Warningf("Approval is enabled without approval file or configmap, %d recovery steps are skipped in the unattended run", len(runnable.Steps))
+		return withApproved(plan, Plan{}), nil
+	}
+	approved, err := storeApproval(runnable, store)
+	if err != nil {
+		return Plan{}, err
+	}
+	return withApproved(plan, approved), nil
+}
+
+// withApproved returns the plan without the runnable steps which are not approved
+func withApproved(plan Plan, approved Plan) Plan {
+	ids := make(map[string]int)
+	for _, step := range approved.Steps {
+		ids[step.ID()]++
+	}
+	result := Plan{Created: plan.Created}
+	for _, step := range plan.Steps {
+		if step.Skip == "" && step.Error == "" {
+			id := step.ID()
+			if ids[id] == 0 {
+				continue
+			}
+			ids[id]--
+		}
+		result.Steps = append(result.Steps, step)
+	}
+	return result
+}
+
+// promptApproval asks for every step: yes, no, all for the remaining steps of the rule, or quit
+func promptApproval(plan Plan, in io.Reader, out io.Writer) (Plan, error) {
+	approved := Plan{Created: plan.Created}
+	allRules := make(map[string]bool)
+	reader := bufio.NewReader(in)
+	for _, step := range plan.Steps {
+		if allRules[step.Rule] {
+			approved.Steps = append(approved.Steps, step)
+			continue
+		}
+		for {
+			fmt.Fprintf(out, "[%s] %s %s", step.Rule, step.Type, step.target())
+			if step.Node != "" {
+				fmt.Fprintf(out, " on %s(%s)", step.Node, step.NodeIP)
+			}
+			fmt.Fprintf(out, ": %s", step.Command)
+			fmt.Fprint(out, "\nExecute? [y]es/[n]o/[a]ll of the rule/[q]uit: ")
+			answer, err := reader.ReadString('\n')
+			if err != nil && answer == "" {
+				return approved, fmt.Errorf("read approval: %v", err)
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				approved.Steps = append(approved.Steps, step)
+			case "n", "no":
+			case "a", "all":
+				allRules[step.Rule] = true
+				approved.Steps = append(approved.Steps, step)
+			case "q", "quit":
+				glog.Infof("Approval quit, %d of %d recovery steps approved", len(approved.Steps), len(plan.Steps))
+				return approved, nil
+			default:
+				continue
+			}
+			break
+		}
+	}
+	return approved, nil
+}
+
+// storeApproval returns the approved steps of the plan and saves the others into the store.
+// Approved steps are removed from the store, they need a new approval if the target fails again.
+// Approvals of steps no longer planned are dropped.
+func storeApproval(plan Plan, store ApprovalStore) (Plan, error) {
+	approvals, err := store.Load()
+	if err != nil {
+		return Plan{}, err
+	}
+	byID := make(map[string]Approval, len(approvals))
+	for _, a := range approvals {
+		byID[a.ID] = a
+	}
+
+	now := time.Now()
+	approved := Plan{Created: plan.Created}
+	var next []Approval
+	for _, step := range plan.Steps {
+		id := step.ID()
+		a, ok := byID[id]
+		switch {
+		case !ok:
+			glog.Infof("Recovery step %s of rule %s is pending approval: %s %s: %s", id, step.Rule, step.Type, step.target(), step.Command)
+			next = append(next, Approval{ID: id, Status: PENDING, Created: now, Updated: now, Step: step})
+		case a.Status == APPROVED:
+			glog.Infof("Recovery step %s of rule %s is approved", id, step.Rule)
+			approved.Steps = append(approved.Steps, step)
+		case a.Status == REJECTED:
+			glog.Infof("Recovery step %s of rule %s is rejected, skipped", id, step.Rule)
+			next = append(next, a)
+		default:
+			glog.Infof("Recovery step %s of rule %s is still pending approval", id, step.Rule)
+			a.Step = step
+			next = append(next, a)
+		}
+	}
+	if err := store.Save(next); err != nil {
+		return Plan{}, err
+	}
+	return approved, nil
+}
+
+// SetStatus sets the status of the approvals with the ids, all pending approvals if no id is given
+func SetStatus(store ApprovalStore, status string, ids []string) ([]Approval, error) {
+	approvals, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for i, a := range approvals {
+		match := len(ids) == 0 && a.Status == PENDING
+		for _, id := range ids {
+			if strings.HasPrefix(a.ID, id) {
+				match = true
+				found[id] = true
+			}
+		}
+		if match {
+			approvals[i].Status = status
+			approvals[i].Updated = time.Now()
+		}
+	}
+	for _, id := range ids {
+		if !found[id] {
+			return nil, fmt.Errorf("approval %s not found", id)
+		}
+	}
+	return approvals, store.Save(approvals)
+}
+
+// WriteApprovals writes the approvals as a tab separated table
+func WriteApprovals(out io.Writer, approvals []Approval) error {
+	const padding = 4
+	w := tabwriter.NewWriter(out, 0, 0, padding, ' ', 0)
+	if _, err := fmt.Fprintln(w, "ID\tSTATUS\tRULE\tTYPE\tTARGET\tNODE\tCOMMAND\tUPDATED"); err != nil {
+		return err
+	}
+	for _, a := range approvals {
+		row := []string{a.ID, a.Status, a.Step.Rule, a.Step.Type, a.Step.target(), a.Step.Node, a.Step.Command, a.Updated.Format("2006-01-02 15:04:05")}
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// approvalStore keeps the approvals as json in the file or the ConfigMap
+type approvalStore struct {
+	store  blobStore
+	source string
+}
+
+func (a approvalStore) Load() ([]Approval, error) {
+	content, err := a.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalApprovals(content, a.source)
+}
+
+func (a approvalStore) Save(approvals []Approval) error {
+	content, err := marshalApprovals(approvals)
+	if err != nil {
+		return err
+	}
+	return a.store.Save(content)
+}
+
+func marshalApprovals(approvals []Approval) ([]byte, error) {
+	if approvals == nil {
+		approvals = []Approval{}
+	}
+	return json.MarshalIndent(approvals, "", "  ")
+}
+
+func unmarshalApprovals(content []byte, source string) ([]Approval, error) {
+	var approvals []Approval
+	if len(strings.TrimSpace(string(content))) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(content, &approvals); err != nil {
+		return nil, fmt.Errorf("approvals %s: %v", source, err)
+	}
+	return approvals, nil
+}
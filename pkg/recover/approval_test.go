@@ -0,0 +1,189 @@
+package recover
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlanSaveLoad(t *testing.T) {
+	exitCode := 1
+	plan := Plan{
+		Created: time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC),
+		Steps: []Step{
+			{Rule: "pending-pod", Type: PODTYPE, Action: "restart", Namespace: "default", Pod: "web-1", Owner: "ReplicaSet/web-5d8f",
+				Workload: "Deployment/web", Operation: OPROLLOUTRESTART, Command: rolloutCommand("default", "Deployment/web"), Timeout: "2m",
+				Status: SUCCESS, Verify: RESOLVED},
+			{Rule: "oom", Type: EXECTYPE, Action: "kill -HUP 1", Namespace: "default", Pod: "api-1", Container: "api", Operation: OPEXEC,
+				Command: "kill -HUP 1", Stderr: "no such process", ExitCode: &exitCode, Status: FAILED, Reason: "exec error"},
+			{Rule: "kubelet", Type: SERVICETYPE, Action: "restart", Service: "kubelet", Instance: "10.0.0.1", Node: "node-1", NodeIP: "10.0.0.1",
+				SSHHost: "10.0.0.1", Operation: OPSSH, Command: "systemctl restart kubelet", Skip: "in cooldown", Status: SKIPPED, Reason: "in cooldown"},
+		},
+		Summary: &Summary{Success: 1, Skipped: 1, Failed: 1, Failures: []string{"rule oom exec default/api-1: exec error"}},
+	}
+	file := filepath.Join(t.TempDir(), "plan.json")
+	if err := plan.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPlan(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, plan) {
+		t.Errorf("LoadPlan() = %+v, want %+v", loaded, plan)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("steps: []"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPlan(file); err == nil || !strings.Contains(err.Error(), file) {
+		t.Errorf("LoadPlan() of yaml error = %v, want the json error of the file", err)
+	}
+	if _, err := LoadPlan(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("LoadPlan() of a missing file should fail")
+	}
+}
+
+func TestApprove(t *testing.T) {
+	step := func(pod string) Step {
+		return Step{Rule: "pending-pod", Type: PODTYPE, Action: "delete", Namespace: "default", Pod: pod, Operation: OPDELETEPOD,
+			Command: "DELETE /api/v1/namespaces/default/pods/" + pod}
+	}
+	skipped, failed := step("skipped"), step("failed")
+	skipped.Skip = "in cooldown"
+	failed.Error = "pod not found"
+	pods := func(plan Plan) string {
+		var names []string
+		for _, s := range plan.Steps {
+			names = append(names, s.Pod)
+		}
+		return strings.Join(names, ",")
+	}
+	statuses := func(approvals []Approval) string {
+		var s []string
+		for _, a := range approvals {
+			s = append(s, a.Step.Pod+"="+a.Status)
+		}
+		return strings.Join(s, ",")
+	}
+	// the approvals of an unattended run are read from a file, not a terminal
+	in, err := os.Create(filepath.Join(t.TempDir(), "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	tests := []struct {
+		name   string
+		config ApprovalConfig
+	}{
+		{name: "file", config: ApprovalConfig{Enable: true, StoreConfig: StoreConfig{File: filepath.Join(t.TempDir(), "approvals.json")}}},
+		{name: "configmap", config: ApprovalConfig{Enable: true, StoreConfig: StoreConfig{ConfigMap: "monitoring/patrol"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			store, err := tt.config.Store(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			approve := func(steps ...Step) Plan {
+				t.Helper()
+				plan, err := tt.config.Approve(Plan{Steps: steps}, client, in, os.Stdout)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return plan
+			}
+			load := func() []Approval {
+				t.Helper()
+				approvals, err := store.Load()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return approvals
+			}
+
+			// the new steps are pending, the steps skipped or with an error are kept to be reported
+			if got := pods(approve(step("web-1"), step("web-2"), skipped, failed)); got != "skipped,failed" {
+				t.Errorf("first run steps = %s, want skipped,failed", got)
+			}
+			if got := statuses(load()); got != "web-1=pending,web-2=pending" {
+				t.Errorf("approvals = %s, want web-1 and web-2 pending", got)
+			}
+
+			// approved by the prefix of the id, then the other pending ones rejected
+			if _, err := SetStatus(store, APPROVED, []string{step("web-1").ID()[:6]}); err != nil {
+				t.Fatal(err)
+			}
+			approvals, err := SetStatus(store, REJECTED, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := statuses(approvals); got != "web-1=approved,web-2=rejected" {
+				t.Errorf("approvals = %s, want web-1 approved and web-2 rejected", got)
+			}
+			if _, err := SetStatus(store, APPROVED, []string{"missing"}); err == nil {
+				t.Errorf("SetStatus() of an unknown id should fail")
+			}
+
+			// the approved step runs and needs a new approval next time, the rejected one stays rejected
+			if got := pods(approve(step("web-1"), step("web-2"), step("web-3"))); got != "web-1" {
+				t.Errorf("second run steps = %s, want web-1", got)
+			}
+			if got := statuses(load()); got != "web-2=rejected,web-3=pending" {
+				t.Errorf("approvals = %s, want web-2 rejected and web-3 pending", got)
+			}
+
+			// the approvals of the steps no longer planned expire
+			if got := pods(approve(step("web-3"))); got != "" {
+				t.Errorf("third run steps = %s, want none", got)
+			}
+			if got := statuses(load()); got != "web-3=pending" {
+				t.Errorf("approvals = %s, want only web-3 pending", got)
+			}
+		})
+	}
+
+	plan := Plan{Steps: []Step{step("web-1"), skipped}}
+	if got, err := (ApprovalConfig{}).Approve(plan, nil, in, os.Stdout); err != nil || pods(got) != "web-1,skipped" {
+		t.Errorf("Approve() disabled = %s, %v, want the plan as is", pods(got), err)
+	}
+	if got, err := (ApprovalConfig{Enable: true}).Approve(plan, nil, in, os.Stdout); err != nil || pods(got) != "skipped" {
+		t.Errorf("Approve() without store = %s, %v, want no runnable step", pods(got), err)
+	}
+}
+
+func TestPromptApproval(t *testing.T) {
+	step := func(rule, pod string) Step {
+		return Step{Rule: rule, Type: PODTYPE, Namespace: "default", Pod: pod, Command: "DELETE " + pod}
+	}
+	plan := Plan{Steps: []Step{step("a", "a-1"), step("a", "a-2"), step("b", "b-1"), step("b", "b-2"), step("c", "c-1")}}
+	var out strings.Builder
+	// an unknown answer is asked again
+	approved, err := promptApproval(plan, strings.NewReader("y\nmaybe\nn\nall\nq\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pods []string
+	for _, s := range approved.Steps {
+		pods = append(pods, s.Pod)
+	}
+	if got := strings.Join(pods, ","); got != "a-1,b-1,b-2" {
+		t.Errorf("promptApproval() approved %s, want a-1,b-1,b-2", got)
+	}
+	if n := strings.Count(out.String(), "Execute?"); n != 5 {
+		t.Errorf("promptApproval() asked %d times, want 5", n)
+	}
+
+	// the input ends before every step is answered
+	if _, err := promptApproval(plan, strings.NewReader("y\n"), &out); err == nil {
+		t.Errorf("promptApproval() of a closed input should fail")
+	}
+}
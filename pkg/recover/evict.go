@@ -0,0 +1,67 @@
+package recover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrEvictionBlocked is returned when a PodDisruptionBudget blocks the eviction until the timeout,
+// the eviction is reported instead of failing the recovery
+var ErrEvictionBlocked = errors.New("eviction blocked by PodDisruptionBudget")
+
+// DefaultEvictTimeout is the time to retry an eviction blocked by a PodDisruptionBudget if the rule has no evict-timeout
+const DefaultEvictTimeout = 5 * time.Minute
+
+// eviction retry backoff while a PodDisruptionBudget blocks it
+var (
+	evictionBackoff    = 5 * time.Second
+	maxEvictionBackoff = time.Minute
+)
+
+// evictCommand is the API call of the eviction of the pod
+func evictCommand(namespace, pod string) string {
+	return fmt.Sprintf("POST /api/v1/namespaces/%s/pods/%s/eviction", namespace, pod)
+}
+
+// evictPod evicts the pod through the policy/v1 Eviction subresource, retrying with backoff while
+// a PodDisruptionBudget blocks it, and waits for the pod to be deleted.
+// gracePeriod is the termination grace period of the pod, nil for its own.
+func evictPod(podName, namespace string, gracePeriod *int64, timeout time.Duration, client kubernetes.Interface) error {
+	eviction := &policyv1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Name: podName, Namespace: namespace},
+		DeleteOptions: &metav1.DeleteOptions{GracePeriodSeconds: gracePeriod},
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := evictionBackoff
+	for {
+		err := client.CoreV1().Pods(namespace).EvictV1(context.TODO(), eviction)
+		switch {
+		case err == nil:
+			glog.Infof("Evicting pod %s in %s", podName, namespace)
+			return watchPodDeletion(podName, namespace, client)
+		case apierrors.IsNotFound(err):
+			glog.Infof("Pod %s in %s is already deleted", podName, namespace)
+			return nil
+		case !apierrors.IsTooManyRequests(err):
+			glog.Error(err)
+			return err
+		}
+		// 429 is returned while the PodDisruptionBudget does not allow the disruption
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("pod %s in %s: %w in %s: %v", podName, namespace, ErrEvictionBlocked, timeout, err)
+		}
+		glog.Warningf("Eviction of pod %s in %s blocked, retry in %s: %v", podName, namespace, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxEvictionBackoff {
+			backoff = maxEvictionBackoff
+		}
+	}
+}
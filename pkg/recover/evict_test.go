@@ -0,0 +1,62 @@
+package recover
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestEvictPod(t *testing.T) {
+	evictionBackoff, maxEvictionBackoff = 10*time.Millisecond, 20*time.Millisecond
+	defer func() { evictionBackoff, maxEvictionBackoff = 5*time.Second, time.Minute }()
+
+	// evictions returns the fake client whose evictions are blocked by the PodDisruptionBudget the first times
+	evictions := func(blocked int) (*fake.Clientset, *int) {
+		client := fake.NewSimpleClientset(testPod("zk-0", nil, nil))
+		calls := 0
+		client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() != "eviction" {
+				return false, nil, nil
+			}
+			calls++
+			if calls <= blocked {
+				return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+			}
+			gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+			return true, nil, client.Tracker().Delete(gvr, "default", "zk-0")
+		})
+		return client, &calls
+	}
+
+	client, calls := evictions(1)
+	if err := evictPod("zk-0", "default", nil, time.Minute, client); err != nil {
+		t.Fatalf("evictPod() error = %v", err)
+	}
+	if *calls != 2 {
+		t.Errorf("evictPod() evicted %d times, want 2", *calls)
+	}
+
+	// blocked until the evict-timeout of the step, not the timeout of the rollout
+	client, calls = evictions(100)
+	s := Step{Rule: "zk", Type: PODTYPE, Namespace: "default", Pod: "zk-0", Operation: OPEVICTPOD, Timeout: "10m", EvictTimeout: "50ms"}
+	start := time.Now()
+	err := s.Execute(client, nil, nil)
+	if !errors.Is(err, ErrEvictionBlocked) || !strings.Contains(err.Error(), "in 50ms") {
+		t.Errorf("Execute() error = %v, want blocked in 50ms", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second || *calls < 2 {
+		t.Errorf("Execute() evicted %d times in %s, want retries within the evict-timeout", *calls, elapsed)
+	}
+
+	// the pod is gone already
+	if err := evictPod("zk-1", "default", nil, time.Minute, fake.NewSimpleClientset()); err != nil {
+		t.Errorf("evictPod() of a deleted pod error = %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package recover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// stateKey is the key of the limit state in the data of the ConfigMap
+const stateKey = "state.json"
+
+// budgetWindow is the window of the daily budget
+const budgetWindow = 24 * time.Hour
+
+// State is the recovery history the cooldowns and the daily budgets are checked against
+type State struct {
+	// Targets is the last recovery time of every target
+	Targets map[string]time.Time `json:"targets"`
+	// Actions is the recovery times of every rule in the budget window
+	Actions map[string][]time.Time `json:"actions"`
+}
+
+// Limiter skips the steps over the limits of their rule and records the executed steps.
+// The cooldowns and the daily budgets require the state kept in the file or the ConfigMap.
+type Limiter struct {
+	limits map[string]common.Recover
+	store  blobStore
+	source string
+	state  State
+	now    time.Time
+	// recorded are the targets recovered by this run, their escalation is not in cooldown
+	recorded map[string]bool
+}
+
+// NewLimiter loads the state of the store config and returns the limiter of the recover settings of the rules
+func NewLimiter(cfg StoreConfig, client kubernetes.Interface, rules []common.Rule) (*Limiter, error) {
+	l := &Limiter{
+		limits: make(map[string]common.Recover, len(rules)),
+		source: cfg.source(),
+		state: State{
+			Targets: make(map[string]time.Time),
+			Actions: make(map[string][]time.Time),
+		},
+		now:      time.Now(),
+		recorded: make(map[string]bool),
+	}
+	for _, rule := range rules {
+		l.limits[rule.Name] = rule.Recover
+	}
+	store, err := cfg.open(client, stateKey)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return l, nil
+	}
+	l.store = store
+	content, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &l.state); err != nil {
+			return nil, fmt.Errorf("recover state %s: %v", l.source, err)
+		}
+	}
+	if l.state.Targets == nil {
+		l.state.Targets = make(map[string]time.Time)
+	}
+	if l.state.Actions == nil {
+		l.state.Actions = make(map[string][]time.Time)
+	}
+	return l, nil
+}
+
+// Apply returns the plan with the steps over the limits of their rule skipped:
+// every step of a rule over max-targets, the targets in cooldown, the pods over max-percent
+// of their owner or namespace and the steps over the daily budget.
+// The targets recovered by this run are not in cooldown, so that they can be escalated.
+func (l *Limiter) Apply(plan Plan, client kubernetes.Interface) Plan {
+	steps := make([]Step, len(plan.Steps))
+	copy(steps, plan.Steps)
+	var rules []string
+	byRule := make(map[string][]int)
+	for i, step := range steps {
+		if _, ok := byRule[step.Rule]; !ok {
+			rules = append(rules, step.Rule)
+		}
+		byRule[step.Rule] = append(byRule[step.Rule], i)
+	}
+
+	for _, rule := range rules {
+		limits := l.limits[rule]
+		indexes := byRule[rule]
+		skip := func(i int, format string, args ...interface{}) {
+			if steps[i].Skip != "" {
+				return
+			}
+			steps[i].Skip = fmt.Sprintf(format, args...)
+			glog.Warningf("Rule %s: %s %s skipped, %s", rule, steps[i].Type, steps[i].target(), steps[i].Skip)
+		}
+
+		// targets already skipped or with an error are not counted
+		targets := 0
+		for _, i := range indexes {
+			if steps[i].Skip == "" && steps[i].Error == "" {
+				targets++
+			}
+		}
+		if limits.MaxTargets > 0 && targets > limits.MaxTargets {
+			glog.Errorf("Rule %s: %d targets exceed max-targets %d, recovery of the rule aborted", rule, targets, limits.MaxTargets)
+			for _, i := range indexes {
+				if steps[i].Error == "" {
+					skip(i, "%d targets exceed max-targets %d", targets, limits.MaxTargets)
+				}
+			}
+			continue
+		}
+
+		if limits.Cooldown != "" {
+			cooldown, err := model.ParseDuration(limits.Cooldown)
+			for _, i := range indexes {
+				switch {
+				case err != nil:
+					skip(i, "invalid cooldown: %v", err)
+				case l.store == nil:
+					skip(i, "cooldown requires recover-state")
+				case l.recorded[steps[i].key()]:
+				default:
+					if last, ok := l.state.Targets[steps[i].key()]; ok && l.now.Sub(last) < time.Duration(cooldown) {
+						skip(i, "in cooldown until %s", last.Add(time.Duration(cooldown)).Format("2006-01-02 15:04:05"))
+					}
+				}
+			}
+		}
+
+		if limits.MaxPercent > 0 {
+			l.applyMaxPercent(steps, indexes, limits.MaxPercent, client, skip)
+		}
+
+		if limits.DailyBudget > 0 {
+			remaining := limits.DailyBudget - len(l.recentActions(rule))
+			for _, i := range indexes {
+				switch {
+				case l.store == nil:
+					skip(i, "daily-budget requires recover-state")
+				case steps[i].Skip != "" || steps[i].Error != "":
+				case remaining <= 0:
+					skip(i, "daily-budget %d exhausted", limits.DailyBudget)
+				default:
+					remaining--
+				}
+			}
+		}
+	}
+	return Plan{Created: plan.Created, Steps: steps}
+}
+
+// applyMaxPercent skips the pods over the percent of the pods of their owner, or of their namespace without owner.
+// The number of pods allowed is rounded up like maxUnavailable of a PodDisruptionBudget.
+func (l *Limiter) applyMaxPercent(steps []Step, indexes []int, percent float64, client kubernetes.Interface, skip func(int, string, ...interface{})) {
+	totals := make(map[string]int)
+	listed := make(map[string]error)
+	count := func(namespace string) error {
+		if err, ok := listed[namespace]; ok {
+			return err
+		}
+		pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+		listed[namespace] = err
+		if err != nil {
+			return err
+		}
+		for i := range pods.Items {
+			totals[namespace]++
+			if owner := metav1.GetControllerOf(&pods.Items[i]); owner != nil {
+				totals[namespace+"/"+owner.Kind+"/"+owner.Name]++
+			}
+		}
+		return nil
+	}
+
+	used := make(map[string]int)
+	for _, i := range indexes {
+		step := steps[i]
+		if step.Type != PODTYPE || step.Skip != "" || step.Error != "" {
+			continue
+		}
+		group, name := step.Namespace, "namespace "+step.Namespace
+		if step.Owner != "" {
+			group, name = step.Namespace+"/"+step.Owner, step.Owner
+		}
+		if err := count(step.Namespace); err != nil {
+			skip(i, "max-percent: list pods of namespace %s: %v", step.Namespace, err)
+			continue
+		}
+		allowed := int(math.Ceil(float64(totals[group]) * percent / 100))
+		if used[group] >= allowed {
+			skip(i, "over max-percent %s%% of the %d pods of %s", strconv.FormatFloat(percent, 'f', -1, 64), totals[group], name)
+			continue
+		}
+		used[group]++
+	}
+}
+
+// recentActions returns the recovery times of the rule in the budget window
+func (l *Limiter) recentActions(rule string) []time.Time {
+	var recent []time.Time
+	for _, t := range l.state.Actions[rule] {
+		if l.now.Sub(t) < budgetWindow {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// Record records the recovery of the step, nothing is recorded by a nil limiter
+func (l *Limiter) Record(step Step) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.recorded[step.key()] = true
+	l.state.Targets[step.key()] = now
+	l.state.Actions[step.Rule] = append(l.state.Actions[step.Rule], now)
+}
+
+// Save saves the state without the records older than the budget window and the longest cooldown
+func (l *Limiter) Save() error {
+	if l == nil || l.store == nil {
+		return nil
+	}
+	retention := budgetWindow
+	for _, limits := range l.limits {
+		if d, err := model.ParseDuration(limits.Cooldown); err == nil && time.Duration(d) > retention {
+			retention = time.Duration(d)
+		}
+	}
+	now := time.Now()
+	for key, t := range l.state.Targets {
+		if now.Sub(t) >= retention {
+			delete(l.state.Targets, key)
+		}
+	}
+	for rule, times := range l.state.Actions {
+		var recent []time.Time
+		for _, t := range times {
+			if now.Sub(t) < budgetWindow {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(l.state.Actions, rule)
+		} else {
+			l.state.Actions[rule] = recent
+		}
+	}
+	content, err := json.MarshalIndent(l.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := l.store.Save(content); err != nil {
+		return fmt.Errorf("recover state %s: %v", l.source, err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package recover
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func podStep(pod, owner string) Step {
+	return Step{Rule: "pending-pod", Type: PODTYPE, Namespace: "default", Pod: pod, Owner: owner, Operation: OPDELETEPOD}
+}
+
+func TestLimiterApply(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	client := fake.NewSimpleClientset(
+		testPod("web-1", nil, controller("ReplicaSet", "web")),
+		testPod("web-2", nil, controller("ReplicaSet", "web")),
+		testPod("web-3", nil, controller("ReplicaSet", "web")),
+		testPod("debug", nil, nil),
+	)
+	failed := podStep("web-9", "")
+	failed.Error = "pod not found"
+	excluded := podStep("web-8", "")
+	excluded.Skip = "excluded by pods [web-8]"
+
+	tests := []struct {
+		name   string
+		limits common.Recover
+		// stateless limiters have no recover-state
+		stateless bool
+		targets   map[string]time.Time
+		actions   []time.Time
+		steps     []Step
+		// skips are the substrings of the skip reasons of the steps, empty if the step is not skipped
+		skips []string
+	}{
+		{
+			name:   "within max-targets",
+			limits: common.Recover{MaxTargets: 2},
+			steps:  []Step{podStep("web-1", ""), podStep("web-2", ""), failed, excluded},
+			skips:  []string{"", "", "", "excluded by"},
+		},
+		{
+			name:   "over max-targets",
+			limits: common.Recover{MaxTargets: 2},
+			steps:  []Step{podStep("web-1", ""), podStep("web-2", ""), podStep("web-3", ""), failed},
+			skips:  []string{"3 targets exceed max-targets 2", "3 targets exceed max-targets 2", "3 targets exceed max-targets 2", ""},
+		},
+		{
+			name:   "max-percent of the owner",
+			limits: common.Recover{MaxPercent: 50},
+			steps:  []Step{podStep("web-1", "ReplicaSet/web"), podStep("web-2", "ReplicaSet/web"), podStep("web-3", "ReplicaSet/web")},
+			skips:  []string{"", "", "over max-percent 50% of the 3 pods of ReplicaSet/web"},
+		},
+		{
+			name:   "max-percent of the namespace",
+			limits: common.Recover{MaxPercent: 20},
+			steps:  []Step{podStep("debug", ""), podStep("other", "")},
+			skips:  []string{"", "over max-percent 20% of the 4 pods of namespace default"},
+		},
+		{
+			name:   "cooldown",
+			limits: common.Recover{Cooldown: "30m"},
+			targets: map[string]time.Time{
+				"pod/default/web-1": now.Add(-10 * time.Minute),
+				// the cooldown is over at its end
+				"pod/default/web-2": now.Add(-30 * time.Minute),
+			},
+			steps: []Step{podStep("web-1", ""), podStep("web-2", ""), podStep("web-3", "")},
+			skips: []string{"in cooldown until 2024-03-01 00:20:00", "", ""},
+		},
+		{
+			name:      "cooldown without recover-state",
+			limits:    common.Recover{Cooldown: "30m"},
+			stateless: true,
+			steps:     []Step{podStep("web-1", "")},
+			skips:     []string{"cooldown requires recover-state"},
+		},
+		{
+			name:   "daily-budget",
+			limits: common.Recover{DailyBudget: 3},
+			// the action a day ago is out of the window
+			actions: []time.Time{now.Add(-24 * time.Hour), now.Add(-23*time.Hour - 59*time.Minute), now.Add(-time.Hour)},
+			steps:   []Step{podStep("web-1", ""), podStep("web-2", "")},
+			skips:   []string{"", "daily-budget 3 exhausted"},
+		},
+		{
+			name:    "daily-budget after the cooldown",
+			limits:  common.Recover{Cooldown: "1h", DailyBudget: 1},
+			targets: map[string]time.Time{"pod/default/web-1": now.Add(-time.Minute)},
+			steps:   []Step{podStep("web-1", ""), podStep("web-2", ""), podStep("web-3", "")},
+			skips:   []string{"in cooldown", "", "daily-budget 1 exhausted"},
+		},
+		{
+			name:      "daily-budget without recover-state",
+			limits:    common.Recover{DailyBudget: 1},
+			stateless: true,
+			steps:     []Step{podStep("web-1", "")},
+			skips:     []string{"daily-budget requires recover-state"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg StoreConfig
+			if !tt.stateless {
+				cfg.File = filepath.Join(t.TempDir(), "state.json")
+			}
+			l, err := NewLimiter(cfg, client, []common.Rule{{Name: "pending-pod", Recover: tt.limits}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.now = now
+			for key, t := range tt.targets {
+				l.state.Targets[key] = t
+			}
+			l.state.Actions["pending-pod"] = tt.actions
+
+			var skipped []string
+			for _, s := range tt.steps {
+				skipped = append(skipped, s.Skip)
+			}
+			plan := l.Apply(Plan{Steps: tt.steps}, client)
+			for i, s := range plan.Steps {
+				if (tt.skips[i] == "") != (s.Skip == "") || !strings.Contains(s.Skip, tt.skips[i]) {
+					t.Errorf("step %s skip = %q, want %q", s.Pod, s.Skip, tt.skips[i])
+				}
+			}
+			for i, s := range tt.steps {
+				if s.Skip != skipped[i] {
+					t.Errorf("Apply() changed the step %s of the plan", s.Pod)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterState(t *testing.T) {
+	rules := []common.Rule{{Name: "pending-pod", Recover: common.Recover{Cooldown: "30m", DailyBudget: 2}}}
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "patrol", Namespace: "monitoring"},
+		Data:       map[string]string{approvalKey: "[]"},
+	})
+	tests := []struct {
+		name string
+		cfg  StoreConfig
+	}{
+		{name: "file", cfg: StoreConfig{File: filepath.Join(t.TempDir(), "state.json")}},
+		{name: "configmap", cfg: StoreConfig{ConfigMap: "monitoring/patrol"}},
+		{name: "new configmap", cfg: StoreConfig{ConfigMap: "monitoring/patrol-state"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLimiter(tt.cfg, client, rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// records older than the budget window and the cooldown are dropped when saved
+			l.state.Targets["pod/default/old"] = time.Now().Add(-25 * time.Hour)
+			l.state.Actions["pending-pod"] = []time.Time{time.Now().Add(-25 * time.Hour)}
+			l.Record(podStep("web-1", ""))
+			if err := l.Save(); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			loaded, err := NewLimiter(tt.cfg, client, rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := loaded.state.Targets["pod/default/old"]; ok || len(loaded.state.Targets) != 1 {
+				t.Errorf("loaded targets = %v, want only pod/default/web-1", loaded.state.Targets)
+			}
+			if n := len(loaded.state.Actions["pending-pod"]); n != 1 {
+				t.Errorf("loaded %d actions, want 1", n)
+			}
+			plan := loaded.Apply(Plan{Steps: []Step{podStep("web-1", ""), podStep("web-2", ""), podStep("web-3", "")}}, client)
+			for i, want := range []string{"in cooldown", "", "daily-budget 2 exhausted"} {
+				if s := plan.Steps[i].Skip; (want == "") != (s == "") || !strings.Contains(s, want) {
+					t.Errorf("step %s skip = %q, want %q", plan.Steps[i].Pod, s, want)
+				}
+			}
+			// the cooldown is over and the budget is refilled a day later
+			loaded.now = time.Now().Add(24 * time.Hour)
+			plan = loaded.Apply(Plan{Steps: []Step{podStep("web-1", ""), podStep("web-2", "")}}, client)
+			for _, s := range plan.Steps {
+				if s.Skip != "" {
+					t.Errorf("step %s skip = %q a day later, want none", s.Pod, s.Skip)
+				}
+			}
+		})
+	}
+
+	// the state shares the ConfigMap with the approvals
+	cm, err := client.CoreV1().ConfigMaps("monitoring").Get(context.TODO(), "patrol", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data[approvalKey] != "[]" || cm.Data[stateKey] == "" {
+		t.Errorf("ConfigMap data = %v, want the approvals and the state", cm.Data)
+	}
+
+	if _, err := NewLimiter(StoreConfig{ConfigMap: "patrol"}, client, rules); err == nil {
+		t.Errorf("NewLimiter() of a ConfigMap without namespace should fail")
+	}
+}
+
+func TestLimiterEscalation(t *testing.T) {
+	rules := []common.Rule{{Name: "pending-pod", Recover: common.Recover{Cooldown: "1h", DailyBudget: 2}}}
+	l, err := NewLimiter(StoreConfig{File: filepath.Join(t.TempDir(), "state.json")}, nil, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// web-1 was recovered by an earlier run, db-0 by this run
+	l.state.Targets["pod/default/web-1"] = time.Now().Add(-time.Minute)
+	l.Record(podStep("db-0", ""))
+
+	escalation := l.Apply(Plan{Steps: []Step{podStep("db-0", ""), podStep("web-1", ""), podStep("web-2", "")}}, nil)
+	for i, want := range []string{"", "in cooldown", "daily-budget 2 exhausted"} {
+		if s := escalation.Steps[i].Skip; (want == "") != (s == "") || !strings.Contains(s, want) {
+			t.Errorf("escalation of %s skip = %q, want %q", escalation.Steps[i].Pod, s, want)
+		}
+	}
+
+	// a new run of the saved state is in the cooldown of db-0
+	if err := l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	next, err := NewLimiter(StoreConfig{File: l.source}, nil, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := next.Apply(Plan{Steps: []Step{podStep("db-0", "")}}, nil).Steps[0].Skip; !strings.Contains(s, "in cooldown") {
+		t.Errorf("db-0 skip = %q in the next run, want in cooldown", s)
+	}
+}
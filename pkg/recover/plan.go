@@ -0,0 +1,382 @@
+package recover
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/ssh"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// operations of the plan steps
+const (
+	OPDELETEPOD = "delete-pod"
+	OPSSH       = "ssh"
+	// OPROLLOUTRESTART restarts the workload controlling the pod
+	OPROLLOUTRESTART = "rollout-restart"
+	// OPEVICTPOD deletes the pod through the Eviction API, respecting PodDisruptionBudgets
+	OPEVICTPOD = "evict-pod"
+	// OPEXEC runs the command in the container of the pod
+	OPEXEC = "exec"
+)
+
+// status of the executed steps
+const (
+	SUCCESS = "success"
+	SKIPPED = "skipped"
+	FAILED  = "failed"
+)
+
+// ErrStepsFailed is returned by the summary of a plan with failed steps
+var ErrStepsFailed = errors.New("recovery steps failed")
+
+// Step is the recovery of a target, resolved to the exact API call or command to run
+type Step struct {
+	Rule      string `json:"rule"`
+	Type      string `json:"type"`
+	Action    string `json:"action"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	// Owner is the controller of the pod, kind/name
+	Owner string `json:"owner,omitempty"`
+	// Workload is the Deployment, StatefulSet or DaemonSet restarted by the step, kind/name
+	Workload string `json:"workload,omitempty"`
+	Node     string `json:"node,omitempty"`
+	NodeIP   string `json:"node_ip,omitempty"`
+	// SSHHost is the host of the hosts inventory the command runs on
+	SSHHost   string `json:"ssh_host,omitempty"`
+	Operation string `json:"operation"`
+	// Command is the command run on the ssh host, or the API call
+	Command string `json:"command"`
+	// Timeout is the time to wait for the rollout to finish or for the command of exec
+	Timeout string `json:"timeout,omitempty"`
+	// EvictTimeout is the time to wait for the PodDisruptionBudget to allow the eviction
+	EvictTimeout string `json:"evict_timeout,omitempty"`
+	// GracePeriod is the termination grace period of the deleted or evicted pod
+	GracePeriod string `json:"grace_period,omitempty"`
+	// Note is how the action is carried out if not as asked, like a restart falling back to delete
+	Note string `json:"note,omitempty"`
+	// Error is why the target could not be resolved, the step fails when executed
+	Error string `json:"error,omitempty"`
+	// Skip is why the step is not selected or over the limits of the rule, the step is not executed
+	Skip string `json:"skip,omitempty"`
+	// Status is the result of the execution of the step, success, skipped or failed, and Reason why it is skipped or failed
+	Status string `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Verify is the outcome of re-evaluating the rule after the step is executed, resolved or still failing
+	Verify string `json:"verify,omitempty"`
+	// Stdout, Stderr and ExitCode are the output of the command of an exec step, ExitCode is nil if it did not run
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	// labels are the labels of the pod, only for the selectors when planned
+	labels map[string]string
+	// metric and value are the sample of the target, only for the action template when planned
+	metric model.Metric
+	value  float64
+	// executed is when the step was executed, the start of the delay of the verification
+	executed time.Time
+}
+
+// Plan is the list of recovery steps of a patrol run, saved by --dry-run and executed later as is
+type Plan struct {
+	Created time.Time `json:"created"`
+	Steps   []Step    `json:"steps"`
+	// Summary is the number of the steps by their status, set when the plan is executed
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// Summary is the number of the executed steps by their status, and the failed targets with the reason
+type Summary struct {
+	Success  int      `json:"success"`
+	Skipped  int      `json:"skipped"`
+	Failed   int      `json:"failed"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d succeeded, %d skipped, %d failed", s.Success, s.Skipped, s.Failed)
+}
+
+// Err returns an error wrapping ErrStepsFailed with the failed targets, nil if no step failed
+func (s Summary) Err() error {
+	if s.Failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s: %s", ErrStepsFailed, s, strings.Join(s.Failures, "; "))
+}
+
+// LoadPlan reads a plan saved by Save
+func LoadPlan(file string) (Plan, error) {
+	var plan Plan
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return plan, err
+	}
+	if err := json.Unmarshal(content, &plan); err != nil {
+		return plan, fmt.Errorf("plan %s: %v", file, err)
+	}
+	return plan, nil
+}
+
+// Save writes the plan as json
+func (p Plan) Save(file string) error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+// Write writes the plan as json, or as a tab separated table for other formats
+func (p Plan) Write(out io.Writer, format string) error {
+	if format == "json" {
+		content, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(content))
+		return err
+	}
+	const padding = 4
+	w := tabwriter.NewWriter(out, 0, 0, padding, ' ', 0)
+	headers := []string{"RULE", "TYPE", "ACTION", "NAMESPACE", "POD", "CONTAINER", "SERVICE", "NODE", "NODE_IP", "SSH_HOST", "COMMAND", "NOTE", "ERROR", "SKIP", "STATUS", "REASON", "VERIFY"}
+	if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+		return err
+	}
+	for _, s := range p.Steps {
+		row := []string{s.Rule, s.Type, s.Action, s.Namespace, s.Pod, s.Container, s.Service, s.Node, s.NodeIP, s.SSHHost, s.Command, s.Note, s.Error, s.Skip, s.Status, s.Reason, s.Verify}
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if p.Summary != nil {
+		_, err := fmt.Fprintf(out, "SUMMARY: %s\n", p.Summary)
+		return err
+	}
+	return nil
+}
+
+// Execute runs the steps of the plan in order, a failed step does not stop the others.
+// Every step is set its status with the reason: skipped steps are not executed, evictions blocked by
+// PodDisruptionBudgets are skipped, the others succeed or fail. The successful steps are recorded by the limiter
+// if not nil, and the time they are executed is kept in the plan for the verification.
+// The config of the client streams the commands of the exec steps. The summary of the plan is returned.
+func (p *Plan) Execute(client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG, limiter *Limiter) Summary {
+	for i := range p.Steps {
+		step := &p.Steps[i]
+		if step.Skip != "" {
+			glog.Warningf("Rule %s: %s %s skipped, %s", step.Rule, step.Type, step.target(), step.Skip)
+			step.Status, step.Reason = SKIPPED, step.Skip
+			continue
+		}
+		err := step.Execute(client, config, sshconfig)
+		switch {
+		case errors.Is(err, ErrEvictionBlocked):
+			glog.Warningf("Rule %s: %v", step.Rule, err)
+			step.Status, step.Reason = SKIPPED, err.Error()
+		case err != nil:
+			glog.Errorf("Rule %s: %s %s failed: %v", step.Rule, step.Type, step.target(), err)
+			step.Status, step.Reason = FAILED, err.Error()
+		default:
+			step.Status = SUCCESS
+			step.executed = time.Now()
+			limiter.Record(*step)
+		}
+	}
+	summary := p.Summarize()
+	p.Summary = &summary
+	glog.Infof("Recovery: %s", summary)
+	return summary
+}
+
+// Summarize counts the executed steps of the plan by their status
+func (p Plan) Summarize() Summary {
+	var summary Summary
+	for _, s := range p.Steps {
+		switch s.Status {
+		case SUCCESS:
+			summary.Success++
+		case SKIPPED:
+			summary.Skipped++
+		case FAILED:
+			summary.Failed++
+			summary.Failures = append(summary.Failures, fmt.Sprintf("rule %s %s %s: %s", s.Rule, s.Type, s.target(), s.Reason))
+		}
+	}
+	return summary
+}
+
+// EvictDeletes returns the plan with the pod deletes done through the Eviction API
+func (p Plan) EvictDeletes() Plan {
+	steps := make([]Step, len(p.Steps))
+	copy(steps, p.Steps)
+	for i := range steps {
+		if steps[i].Operation != OPDELETEPOD {
+			continue
+		}
+		steps[i].Operation = OPEVICTPOD
+		steps[i].Command = evictCommand(steps[i].Namespace, steps[i].Pod)
+		if steps[i].Note != "" {
+			steps[i].Note += ", "
+		}
+		steps[i].Note += "delete through the eviction API"
+	}
+	return Plan{Created: p.Created, Steps: steps}
+}
+
+// Execute runs the API call or the command of the step, the output of an exec command is set in the step
+func (s *Step) Execute(client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG) error {
+	if s.Error != "" {
+		return errors.New(s.Error)
+	}
+	switch s.Operation {
+	case OPDELETEPOD:
+		if err := deletePod(s.Pod, s.Namespace, s.gracePeriod(), client); err != nil {
+			return fmt.Errorf("delete pod error: %v", err)
+		}
+	case OPEVICTPOD:
+		if err := evictPod(s.Pod, s.Namespace, s.gracePeriod(), s.evictTimeout(), client); err != nil {
+			return fmt.Errorf("evict pod error: %w", err)
+		}
+	case OPROLLOUTRESTART:
+		if err := rolloutRestart(s.Namespace, s.Workload, s.timeout(), client); err != nil {
+			return fmt.Errorf("rollout restart error: %v", err)
+		}
+	case OPEXEC:
+		var err error
+		s.Stdout, s.Stderr, s.ExitCode, err = execInContainer(s.Pod, s.Namespace, s.Container, s.Command, s.timeout(), client, config)
+		if err != nil {
+			return fmt.Errorf("exec error: %v", err)
+		}
+	case OPSSH:
+		ip := net.ParseIP(s.SSHHost)
+		sshClient, err := ssh.GetHostSSHClient(ip, sshconfig)
+		if err != nil {
+			return fmt.Errorf("%s %s error: %v", s.Type, s.target(), err)
+		}
+		glog.Infof("Run command '%s' result: ", s.Command)
+		if err := sshClient.CmdAsync(ip, s.Command); err != nil {
+			return fmt.Errorf("%s %s error: %v", s.Type, s.target(), err)
+		}
+		glog.Infof("[%s %s]Run command '%s' successfully", s.Node, s.NodeIP, s.Command)
+	default:
+		return fmt.Errorf("rule %s: unknown operation %s", s.Rule, s.Operation)
+	}
+	return nil
+}
+
+// timeout returns the timeout of the step, the default timeout if not set or invalid
+func (s Step) timeout() time.Duration {
+	d, err := model.ParseDuration(s.Timeout)
+	if s.Timeout == "" || err != nil {
+		return DefaultRolloutTimeout
+	}
+	return time.Duration(d)
+}
+
+// evictTimeout returns the eviction timeout of the step, the default timeout if not set or invalid
+func (s Step) evictTimeout() time.Duration {
+	d, err := model.ParseDuration(s.EvictTimeout)
+	if s.EvictTimeout == "" || err != nil {
+		return DefaultEvictTimeout
+	}
+	return time.Duration(d)
+}
+
+// gracePeriod returns the grace period of the step in seconds, nil for the grace period of the pod
+func (s Step) gracePeriod() *int64 {
+	d, err := model.ParseDuration(s.GracePeriod)
+	if s.GracePeriod == "" || err != nil {
+		return nil
+	}
+	seconds := int64(time.Duration(d) / time.Second)
+	return &seconds
+}
+
+// target is the pod or the service of the step
+func (s Step) target() string {
+	if s.Service != "" {
+		return s.Service
+	}
+	return s.Namespace + "/" + s.Pod
+}
+
+// key identifies the target across runs, the pod, the restarted workload or the service on its node
+func (s Step) key() string {
+	if s.Workload != "" {
+		return s.Type + "/" + s.Namespace + "/" + s.Workload
+	}
+	if s.Service != "" {
+		host := s.Node
+		if host == "" {
+			host = s.Instance
+		}
+		return s.Type + "/" + s.Service + "@" + host
+	}
+	return s.Type + "/" + s.Namespace + "/" + s.Pod
+}
+
+// resolveNode sets the node and the owner of the pod, and the ssh host if the step runs a command.
+// The pod is returned, nil if it is not found.
+func (s *Step) resolveNode(client kubernetes.Interface, sshconfig *common.SSHCONFIG) *corev1.Pod {
+	pod, err := getPodByName(s.Pod, s.Namespace, client)
+	if err != nil {
+		s.Error = err.Error()
+		return nil
+	}
+	nodeIP := pod.Status.HostIP
+	s.Node, s.NodeIP = pod.Spec.NodeName, nodeIP
+	s.labels = pod.Labels
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		s.Owner = owner.Kind + "/" + owner.Name
+	}
+	if s.Operation != OPSSH {
+		return pod
+	}
+	if nodeIP == "" {
+		s.Error = fmt.Sprintf("node of pod %s not found", s.Pod)
+		return pod
+	}
+	if !inInventory(net.ParseIP(nodeIP), sshconfig) {
+		s.Error = fmt.Sprintf("host ip %s not in hosts ip list", nodeIP)
+		return pod
+	}
+	s.SSHHost = nodeIP
+	return pod
+}
+
+// inInventory returns true if the ip is one of the hosts
+func inInventory(ip net.IP, sshconfig *common.SSHCONFIG) bool {
+	if sshconfig == nil {
+		return false
+	}
+	for _, host := range sshconfig.Hosts {
+		for _, hostIP := range host.IPS {
+			if ip.Equal(hostIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
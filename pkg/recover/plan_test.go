@@ -0,0 +1,72 @@
+package recover
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlanExecute(t *testing.T) {
+	client := fake.NewSimpleClientset(testPod("web-2", nil, nil))
+	limiter, err := NewLimiter(StoreConfig{File: filepath.Join(t.TempDir(), "state.json")}, client, []common.Rule{{Name: "pending-pod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unresolved := podStep("web-3", "")
+	unresolved.Error = "pod web-3 not found"
+	skipped := podStep("web-4", "")
+	skipped.Skip = "in cooldown"
+	// the first step fails, the others are still executed
+	plan := Plan{Steps: []Step{podStep("web-1", ""), podStep("web-2", ""), unresolved, skipped}}
+
+	summary := plan.Execute(client, nil, nil, limiter)
+	if summary.Success != 1 || summary.Skipped != 1 || summary.Failed != 2 {
+		t.Errorf("Execute() = %s, want 1 succeeded, 1 skipped, 2 failed", summary)
+	}
+	if plan.Summary == nil || plan.Summary.String() != summary.String() {
+		t.Errorf("plan summary = %v, want %s", plan.Summary, summary)
+	}
+	for i, want := range []string{FAILED, SUCCESS, FAILED, SKIPPED} {
+		if s := plan.Steps[i]; s.Status != want {
+			t.Errorf("step %s status = %s, want %s", s.Pod, s.Status, want)
+		}
+	}
+	if r := plan.Steps[0].Reason; !strings.Contains(r, "delete pod error") {
+		t.Errorf("failed step reason = %q, want the delete error", r)
+	}
+	if r := plan.Steps[3].Reason; r != "in cooldown" {
+		t.Errorf("skipped step reason = %q, want in cooldown", r)
+	}
+	for _, s := range plan.Steps {
+		if s.executed.IsZero() != (s.Status != SUCCESS) {
+			t.Errorf("step %s executed at %v, only the successful step should be", s.Pod, s.executed)
+		}
+	}
+	if at := plan.ExecutedAt("pending-pod"); !at.Equal(plan.Steps[1].executed) {
+		t.Errorf("ExecutedAt() = %v, want the time of web-2", at)
+	}
+	if !limiter.recorded["pod/default/web-2"] || len(limiter.state.Targets) != 1 {
+		t.Errorf("limiter recorded %v, want only web-2", limiter.state.Targets)
+	}
+
+	err = summary.Err()
+	if !errors.Is(err, ErrStepsFailed) {
+		t.Fatalf("Err() = %v, want ErrStepsFailed", err)
+	}
+	for _, target := range []string{"default/web-1", "pod web-3 not found"} {
+		if !strings.Contains(err.Error(), target) {
+			t.Errorf("Err() = %v, want the failure of %s", err, target)
+		}
+	}
+	if got := plan.Summarize(); got.String() != summary.String() || len(got.Failures) != 2 {
+		t.Errorf("Summarize() = %s %v, want %s", got, got.Failures, summary)
+	}
+	if err := (Summary{Success: 1, Skipped: 1}).Err(); err != nil {
+		t.Errorf("Err() without failures = %v, want nil", err)
+	}
+}
@@ -7,52 +7,93 @@ import (
 
 	"github.com/prometheus/common/model"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
+// recovery types
+const (
+	PODTYPE     = "pod"
+	SERVICETYPE = "service"
+	// EXECTYPE runs the action in the container of the pod
+	EXECTYPE = "exec"
+)
+
+// BuiltinActions are the builtin actions of every recovery type, other actions run as shell commands.
+// Every action of exec is a command run in the container.
+var BuiltinActions = map[string][]string{
+	PODTYPE:     {"delete", "restart", "evict"},
+	SERVICETYPE: {"start", "stop", "restart", "disable", "enable"},
+	EXECTYPE:    {},
+}
+
+// IsBuiltinAction returns true if the action is a builtin action of the recovery type
+func IsBuiltinAction(recoveryType, action string) bool {
+	for _, a := range BuiltinActions[recoveryType] {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
 type RecoverInterface interface {
-	Recover(client kubernetes.Interface, sshconfig *common.SSHCONFIG, action string) error
+	// Plan resolves the targets of the action into steps without changing anything
+	Plan(client kubernetes.Interface, sshconfig *common.SSHCONFIG, action string) []Step
+	// Recover plans and executes the action, the config of the client streams the commands of exec
+	Recover(client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG, action string) error
+}
+
+// GetErrorList returns the pods or services that the recovery type picks from the query result,
+// an ErrorPodList or an ErrorServiceList
+func GetErrorList(recoveryType string, result interface{}) (interface{}, error) {
+	switch recoveryType {
+	case PODTYPE, EXECTYPE:
+		return getErrorListFromResults(result, false)
+	case SERVICETYPE:
+		return getErrorListFromResults(result, true)
+	default:
+		return nil, fmt.Errorf("unsupported type: %v", recoveryType)
+	}
 }
 
 func getErrorListFromResults(result interface{}, isErrorService bool) (interface{}, error) {
 	var errpList ErrorPodList
 	var errsList ErrorServiceList
 
+	add := func(metric model.Metric, value model.SampleValue) {
+		if isErrorService {
+			err := ErrorService{
+				ServiceName: string(metric["name"]),
+				Instance:    string(metric["instance"]),
+				PodName:     string(metric["pod"]),
+				Metric:      metric,
+				Value:       float64(value),
+			}
+			errsList = append(errsList, err)
+		} else {
+			err := ErrorPod{
+				PodName:      string(metric["pod"]),
+				PodNameSpace: string(metric["namespace"]),
+				Instance:     string(metric["instance"]),
+				Metric:       metric,
+				Value:        float64(value),
+			}
+			errpList = append(errpList, err)
+		}
+	}
 	switch r := result.(type) {
 	case model.Vector:
 		for _, v := range r {
-			if isErrorService {
-				err := ErrorService{
-					ServiceName: string(v.Metric["name"]),
-					Instance:    string(v.Metric["instance"]),
-					PodName:     string(v.Metric["pod"]),
-				}
-				errsList = append(errsList, err)
-			} else {
-				err := ErrorPod{
-					PodName:      string(v.Metric["pod"]),
-					PodNameSpace: string(v.Metric["namespace"]),
-					Instance:     string(v.Metric["instance"]),
-				}
-				errpList = append(errpList, err)
-			}
+			add(v.Metric, v.Value)
 		}
 	case model.Matrix:
+		// the value of a series is its last value
 		for _, m := range r {
-			if isErrorService {
-				err := ErrorService{
-					ServiceName: string(m.Metric["name"]),
-					Instance:    string(m.Metric["instance"]),
-					PodName:     string(m.Metric["pod"]),
-				}
-				errsList = append(errsList, err)
-			} else {
-				err := ErrorPod{
-					PodName:      string(m.Metric["pod"]),
-					PodNameSpace: string(m.Metric["namespace"]),
-					Instance:     string(m.Metric["instance"]),
-				}
-				errpList = append(errpList, err)
+			var value model.SampleValue
+			if len(m.Values) > 0 {
+				value = m.Values[len(m.Values)-1].Value
 			}
+			add(m.Metric, value)
 		}
 	default:
 		return nil, fmt.Errorf("unsupported result type: %v", r)
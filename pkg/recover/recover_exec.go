@@ -0,0 +1,148 @@
+package recover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// defaultContainerAnnotation selects the default container of kubectl exec
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// ErrorExecList is the pods whose container runs the action
+type ErrorExecList struct {
+	Pods ErrorPodList
+	// Container is the name or the wildcard pattern of the container, empty for the default container
+	Container string
+}
+
+func NewExecRecover(result interface{}, container string) RecoverInterface {
+	errListInterface, err := getErrorListFromResults(result, false)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+
+	glog.Infof("Error pod list: %v", errListInterface)
+	epl, ok := errListInterface.(ErrorPodList)
+	if !ok {
+		glog.Errorf("error converting to ErrorPodList slice")
+		return nil
+	}
+	return ErrorExecList{Pods: epl, Container: container}
+}
+
+// Plan resolves the container of every pod the action runs in
+func (eel ErrorExecList) Plan(client kubernetes.Interface, sshconfig *common.SSHCONFIG, action string) []Step {
+	var steps []Step
+	for _, errPod := range eel.Pods {
+		step := Step{
+			Type:      EXECTYPE,
+			Action:    action,
+			Namespace: errPod.PodNameSpace,
+			Pod:       errPod.PodName,
+			Instance:  errPod.Instance,
+			Operation: OPEXEC,
+			Command:   action,
+			metric:    errPod.Metric,
+			value:     errPod.Value,
+		}
+		if pod := step.resolveNode(client, sshconfig); pod != nil {
+			container, err := selectContainer(pod, eel.Container)
+			if err != nil {
+				step.Error = err.Error()
+			}
+			step.Container = container
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+func (eel ErrorExecList) Recover(client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG, action string) error {
+	plan := Plan{Steps: eel.Plan(client, sshconfig, action)}
+	return plan.Execute(client, config, sshconfig, nil).Err()
+}
+
+// selectContainer returns the first container of the pod matching the pattern,
+// or the default container of kubectl exec if the pattern is empty
+func selectContainer(pod *corev1.Pod, pattern string) (string, error) {
+	if len(pod.Spec.Containers) == 0 {
+		return "", fmt.Errorf("pod %s has no container", pod.Name)
+	}
+	if pattern == "" {
+		if name := pod.Annotations[defaultContainerAnnotation]; name != "" {
+			return name, nil
+		}
+		return pod.Spec.Containers[0].Name, nil
+	}
+	var names []string
+	for _, c := range pod.Spec.Containers {
+		if ok, _ := filepath.Match(pattern, c.Name); ok {
+			return c.Name, nil
+		}
+		names = append(names, c.Name)
+	}
+	return "", fmt.Errorf("no container of pod %s matches %s, containers: %s", pod.Name, pattern, strings.Join(names, ", "))
+}
+
+// execInContainer runs the command with sh -c in the container, logging its stdout and stderr.
+// The config of the client streams the command.
+// The output is returned with the exit code, nil if the command did not run. A non-zero exit code is returned as an error.
+func execInContainer(podName, namespace, container, command string, timeout time.Duration, client kubernetes.Interface, config *rest.Config) (string, string, *int, error) {
+	if config == nil {
+		return "", "", nil, fmt.Errorf("exec in pod %s: kube client config is not available", podName)
+	}
+	req := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   []string{"sh", "-c", command},
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	var exitCode *int
+	if exitErr, ok := err.(utilexec.ExitError); ok {
+		code := exitErr.ExitStatus()
+		exitCode = &code
+	} else if err == nil {
+		code := 0
+		exitCode = &code
+	}
+	glog.Infof("[%s/%s %s]Run command '%s' stdout:\n%s", namespace, podName, container, command, stdout.String())
+	if stderr.Len() > 0 {
+		glog.Warningf("[%s/%s %s]Run command '%s' stderr:\n%s", namespace, podName, container, command, stderr.String())
+	}
+	if err != nil {
+		if exitCode != nil {
+			return stdout.String(), stderr.String(), exitCode, fmt.Errorf("command '%s' in %s/%s %s exit code %d: %s", command, namespace, podName, container, *exitCode, strings.TrimSpace(stderr.String()))
+		}
+		return stdout.String(), stderr.String(), nil, fmt.Errorf("command '%s' in %s/%s %s: %v", command, namespace, podName, container, err)
+	}
+	return stdout.String(), stderr.String(), exitCode, nil
+}
@@ -3,22 +3,27 @@ package recover
 import (
 	"context"
 	"fmt"
-	"net"
 	"time"
 
 	"github.com/longxiucai/patrol-tools/pkg/common"
-	"github.com/longxiucai/patrol-tools/pkg/ssh"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type ErrorPod struct {
 	PodName      string
 	PodNameSpace string
 	Instance     string
+	// Metric and Value are the sample of the pod, the data of the action template
+	Metric model.Metric
+	Value  float64
 }
 type ErrorPodList []ErrorPod
 
@@ -38,46 +43,67 @@ func NewPodRecover(result interface{}) RecoverInterface {
 	return epl
 }
 
-func shellPod(podName, namespace, cmd string, client kubernetes.Interface, sshconfig *common.SSHCONFIG) error {
-	nodeName, nodeIP, err := getHostInfoByPodName(podName, namespace, client)
-	if err != nil {
-		return err
-	}
-	ip := net.ParseIP(nodeIP)
-	sshClient, err := ssh.GetHostSSHClient(ip, sshconfig)
-	if err != nil {
-		return err
-	}
-	glog.Infof("Run command '%s' result: ", cmd)
-	err = sshClient.CmdAsync(ip, cmd)
-	if err != nil {
-		return err
-	}
-	glog.Infof("[%s %s]Run command '%s' successfully", nodeName, nodeIP, cmd)
-	return nil
-}
-
-func (epl ErrorPodList) Recover(client kubernetes.Interface, sshconfig *common.SSHCONFIG, action string) error {
+// Plan resolves the node of every pod and the API call or command of the action.
+// restart is a rollout restart of the workload of the pod, deduplicated by DedupeRestarts after the selection,
+// bare pods and pods of other controllers are deleted instead.
+func (epl ErrorPodList) Plan(client kubernetes.Interface, sshconfig *common.SSHCONFIG, action string) []Step {
+	var steps []Step
 	for _, errPod := range epl {
+		step := Step{
+			Type:      PODTYPE,
+			Action:    action,
+			Namespace: errPod.PodNameSpace,
+			Pod:       errPod.PodName,
+			Instance:  errPod.Instance,
+			metric:    errPod.Metric,
+			value:     errPod.Value,
+		}
 		switch action {
 		case "delete":
-			err := deletePod(errPod.PodName, errPod.PodNameSpace, client)
-			if err != nil {
-				return fmt.Errorf("delete pod error: %v", err)
-			}
+			step.Operation = OPDELETEPOD
+			step.Command = fmt.Sprintf("DELETE /api/v1/namespaces/%s/pods/%s", errPod.PodNameSpace, errPod.PodName)
+		case "evict":
+			step.Operation = OPEVICTPOD
+			step.Command = evictCommand(errPod.PodNameSpace, errPod.PodName)
 		case "restart":
-			err := restartPod(errPod.PodName, errPod.PodNameSpace, client)
-			if err != nil {
-				return fmt.Errorf("restart pod error: %v", err)
-			}
+			step.Operation = OPROLLOUTRESTART
 		default:
-			err := shellPod(errPod.PodName, errPod.PodNameSpace, action, client, sshconfig)
-			if err != nil {
-				return fmt.Errorf("shell pod error: %v", err)
-			}
+			step.Operation = OPSSH
+			step.Command = action
 		}
+		pod := step.resolveNode(client, sshconfig)
+		if action == "restart" {
+			step.planRestart(pod, client)
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+func (epl ErrorPodList) Recover(client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG, action string) error {
+	plan := Plan{Steps: DedupeRestarts(epl.Plan(client, sshconfig, action), client, nil)}
+	return plan.Execute(client, config, sshconfig, nil).Err()
+}
+
+// planRestart sets the rollout restart of the workload of the pod, or the delete of the pod if it has none
+func (s *Step) planRestart(pod *corev1.Pod, client kubernetes.Interface) {
+	if pod == nil {
+		s.Command = fmt.Sprintf("PATCH the workload of pod %s/%s (rollout restart)", s.Namespace, s.Pod)
+		return
+	}
+	workload, reason, err := resolveWorkload(pod, client)
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+	if workload == "" {
+		s.Operation = OPDELETEPOD
+		s.Command = fmt.Sprintf("DELETE /api/v1/namespaces/%s/pods/%s", s.Namespace, s.Pod)
+		s.Note = reason + ", restart falls back to delete"
+		return
 	}
-	return nil
+	s.Workload = workload
+	s.Command = rolloutCommand(s.Namespace, workload)
 }
 
 func watchPodDeletion(errPodName, errPodNamespace string, client kubernetes.Interface) error {
@@ -89,6 +115,11 @@ func watchPodDeletion(errPodName, errPodNamespace string, client kubernetes.Inte
 		return err
 	}
 	defer watcher.Stop()
+	// the pod may be deleted before the watch started
+	if _, err := client.CoreV1().Pods(errPodNamespace).Get(context.Background(), errPodName, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		glog.Infof("Pod %s in namespace %s has been deleted\n", errPodName, errPodNamespace)
+		return nil
+	}
 
 	for {
 		select {
@@ -109,30 +140,8 @@ func watchPodDeletion(errPodName, errPodNamespace string, client kubernetes.Inte
 	}
 }
 
-func restartPod(podName, namespace string, client kubernetes.Interface) error {
-	// 获取要重启的 Pod 对象
-	pod, err := client.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
-	if err != nil {
-		glog.Error(err)
-		return err
-	}
-
-	// 更新 Pod 的注释来触发重启
-	pod.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
-	pod.Annotations["kubectl.kubernetes.io/restartedBy"] = common.NAME
-
-	// 更新 Pod 对象以执行重启
-	_, err = client.CoreV1().Pods(namespace).Update(context.TODO(), pod, metav1.UpdateOptions{})
-	if err != nil {
-		glog.Error(err)
-		return err
-	}
-	glog.Infof("Rebooted pod %s in %s", podName, namespace)
-	return nil
-}
-
-func deletePod(podName, namespace string, client kubernetes.Interface) error {
-	err := client.CoreV1().Pods(namespace).Delete(context.Background(), podName, metav1.DeleteOptions{})
+func deletePod(podName, namespace string, gracePeriod *int64, client kubernetes.Interface) error {
+	err := client.CoreV1().Pods(namespace).Delete(context.Background(), podName, metav1.DeleteOptions{GracePeriodSeconds: gracePeriod})
 	if err != nil {
 		glog.Error(err)
 		return err
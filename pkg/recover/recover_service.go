@@ -3,20 +3,24 @@ package recover
 import (
 	"context"
 	"fmt"
-	"net"
 
 	"github.com/longxiucai/patrol-tools/pkg/common"
-	"github.com/longxiucai/patrol-tools/pkg/ssh"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type ErrorService struct {
 	ServiceName string
 	PodName     string
 	Instance    string
+	// Metric and Value are the sample of the service, the data of the action template
+	Metric model.Metric
+	Value  float64
 }
 
 type ErrorServiceList []ErrorService
@@ -37,54 +41,49 @@ func NewServiceRecover(result interface{}) RecoverInterface {
 	return esl
 }
 
-func (esl ErrorServiceList) Recover(client kubernetes.Interface, sshconfig *common.SSHCONFIG, action string) error {
+// Plan resolves the node of every service by its exporter pod and the command of the action
+func (esl ErrorServiceList) Plan(client kubernetes.Interface, sshconfig *common.SSHCONFIG, action string) []Step {
+	var steps []Step
 	for _, errService := range esl {
-		err := doServiceAction(errService, action, sshconfig, client)
-		if err != nil {
-			glog.Error(err)
-			return fmt.Errorf("restart service error: %v", err)
+		step := Step{
+			Type:      SERVICETYPE,
+			Action:    action,
+			Pod:       errService.PodName,
+			Service:   errService.ServiceName,
+			Instance:  errService.Instance,
+			Operation: OPSSH,
+			Command:   action,
+			metric:    errService.Metric,
+			value:     errService.Value,
 		}
+		if IsBuiltinAction(SERVICETYPE, action) {
+			step.Command = fmt.Sprintf("systemctl %s %s", action, errService.ServiceName)
+		}
+		step.resolveNode(client, sshconfig)
+		steps = append(steps, step)
 	}
-	return nil
+	return steps
+}
+
+func (esl ErrorServiceList) Recover(client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG, action string) error {
+	plan := Plan{Steps: esl.Plan(client, sshconfig, action)}
+	return plan.Execute(client, config, sshconfig, nil).Err()
 }
-func getHostInfoByPodName(podname, namespace string, client kubernetes.Interface) (string, string, error) {
-	PodList, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{})
+
+// getPodByName returns the pod with the name, the namespace is optional
+func getPodByName(podname, namespace string, client kubernetes.Interface) (*corev1.Pod, error) {
+	PodList, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
+		FieldSelector: "metadata.name=" + podname,
+	})
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	var nodeName, nodeIP string
-	// 遍历所有 Pod 查找匹配的 Pod 获取所在节点以及节点ip
-	for _, pod := range PodList.Items {
+	// 查找匹配的 Pod 获取所在节点以及节点ip
+	for i, pod := range PodList.Items {
 		if pod.Name == podname {
-			nodeName = pod.Spec.NodeName
-			nodeIP = pod.Status.HostIP
-			glog.Infof("Pod %s running on Node %s %s", podname, nodeName, nodeIP)
+			glog.Infof("Pod %s running on Node %s %s", podname, pod.Spec.NodeName, pod.Status.HostIP)
+			return &PodList.Items[i], nil
 		}
 	}
-	return nodeName, nodeIP, nil
-}
-func doServiceAction(serviceResult ErrorService, action string, sshconfig *common.SSHCONFIG, client kubernetes.Interface) error {
-	nodeName, nodeIP, err := getHostInfoByPodName(serviceResult.PodName, "", client)
-	if err != nil {
-		return err
-	}
-	ip := net.ParseIP(nodeIP)
-	sshClient, err := ssh.GetHostSSHClient(ip, sshconfig)
-	if err != nil {
-		return err
-	}
-
-	var cmd string
-	if action == "start" || action == "stop" || action == "restart" || action == "disable" || action == "enable" {
-		cmd = fmt.Sprintf("systemctl %s %s", action, serviceResult.ServiceName)
-	} else {
-		cmd = action
-	}
-	glog.Infof("run command '%s' result: ", cmd)
-	err = sshClient.CmdAsync(ip, cmd)
-	if err != nil {
-		return err
-	}
-	glog.Infof("[%s %s]Run command '%s' successfully", nodeName, nodeIP, cmd)
-	return nil
+	return nil, fmt.Errorf("pod %s not found", podname)
 }
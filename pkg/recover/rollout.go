@@ -0,0 +1,274 @@
+package recover
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// workload kinds which can be rollout restarted
+const (
+	DEPLOYMENT  = "Deployment"
+	STATEFULSET = "StatefulSet"
+	DAEMONSET   = "DaemonSet"
+)
+
+// DefaultRolloutTimeout is the time to wait for a rollout to finish if the rule has no timeout
+const DefaultRolloutTimeout = 5 * time.Minute
+
+// rolloutPollInterval is the interval of checking the status of a rollout
+const rolloutPollInterval = 2 * time.Second
+
+// resolveWorkload returns the kind/name of the Deployment, StatefulSet or DaemonSet controlling the pod,
+// empty with the reason if the pod can not be rollout restarted
+func resolveWorkload(pod *corev1.Pod, client kubernetes.Interface) (string, string, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", "bare pod without controller", nil
+	}
+	switch owner.Kind {
+	case "ReplicaSet":
+		rs, err := client.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", fmt.Errorf("get ReplicaSet %s of pod %s: %v", owner.Name, pod.Name, err)
+		}
+		if d := metav1.GetControllerOf(rs); d != nil && d.Kind == DEPLOYMENT {
+			return DEPLOYMENT + "/" + d.Name, "", nil
+		}
+		return "", fmt.Sprintf("ReplicaSet/%s without Deployment", owner.Name), nil
+	case STATEFULSET, DAEMONSET:
+		return owner.Kind + "/" + owner.Name, "", nil
+	}
+	return "", fmt.Sprintf("owner %s/%s can not be rollout restarted", owner.Kind, owner.Name), nil
+}
+
+// rolloutCommand is the API call of the rollout restart of the workload
+func rolloutCommand(namespace, workload string) string {
+	kind, name := splitWorkload(workload)
+	return fmt.Sprintf("PATCH /apis/apps/v1/namespaces/%s/%ss/%s (rollout restart)", namespace, strings.ToLower(kind), name)
+}
+
+func splitWorkload(workload string) (string, string) {
+	parts := strings.SplitN(workload, "/", 2)
+	if len(parts) != 2 {
+		return workload, ""
+	}
+	return parts[0], parts[1]
+}
+
+// rolloutRestart patches the restartedAt annotation of the pod template like kubectl rollout restart,
+// and waits for the rollout to finish
+func rolloutRestart(namespace, workload string, timeout time.Duration, client kubernetes.Interface) error {
+	kind, name := splitWorkload(workload)
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`, time.Now().Format(time.RFC3339))
+	apps := client.AppsV1()
+	var generation int64
+	var err error
+	switch kind {
+	case DEPLOYMENT:
+		var d *appsv1.Deployment
+		if d, err = apps.Deployments(namespace).Patch(context.TODO(), name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err == nil {
+			generation = d.Generation
+		}
+	case STATEFULSET:
+		var s *appsv1.StatefulSet
+		if s, err = apps.StatefulSets(namespace).Patch(context.TODO(), name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err == nil {
+			generation = s.Generation
+		}
+	case DAEMONSET:
+		var ds *appsv1.DaemonSet
+		if ds, err = apps.DaemonSets(namespace).Patch(context.TODO(), name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err == nil {
+			generation = ds.Generation
+		}
+	default:
+		return fmt.Errorf("%s can not be rollout restarted", workload)
+	}
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	glog.Infof("Restarted %s in %s, waiting for the rollout", workload, namespace)
+
+	if timeout <= 0 {
+		timeout = DefaultRolloutTimeout
+	}
+	err = wait.PollUntilContextTimeout(context.Background(), rolloutPollInterval, timeout, false, func(ctx context.Context) (bool, error) {
+		return rolloutDone(ctx, namespace, kind, name, generation, client)
+	})
+	if err != nil {
+		if wait.Interrupted(err) {
+			return fmt.Errorf("rollout of %s in %s not finished in %s", workload, namespace, timeout)
+		}
+		return err
+	}
+	glog.Infof("Rollout of %s in %s finished", workload, namespace)
+	return nil
+}
+
+// rolloutDone returns true if the workload observed the generation and all of its pods are updated and available,
+// like kubectl rollout status
+func rolloutDone(ctx context.Context, namespace, kind, name string, generation int64, client kubernetes.Interface) (bool, error) {
+	apps := client.AppsV1()
+	switch kind {
+	case DEPLOYMENT:
+		d, err := apps.Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		// the conditions are of the previous rollout until the controller observed the restart
+		if d.Status.ObservedGeneration < generation {
+			return false, nil
+		}
+		for _, c := range d.Status.Conditions {
+			if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+				return false, fmt.Errorf("rollout of %s/%s exceeded its progress deadline", kind, name)
+			}
+		}
+		replicas := int32(1)
+		if d.Spec.Replicas != nil {
+			replicas = *d.Spec.Replicas
+		}
+		return d.Status.UpdatedReplicas == replicas &&
+			d.Status.Replicas == d.Status.UpdatedReplicas &&
+			d.Status.AvailableReplicas == d.Status.UpdatedReplicas, nil
+	case STATEFULSET:
+		s, err := apps.StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if s.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			glog.Warningf("%s/%s uses the OnDelete update strategy, the pods restart when they are deleted", kind, name)
+			return true, nil
+		}
+		replicas := int32(1)
+		if s.Spec.Replicas != nil {
+			replicas = *s.Spec.Replicas
+		}
+		return s.Status.ObservedGeneration >= generation &&
+			s.Status.UpdatedReplicas == replicas &&
+			s.Status.ReadyReplicas == replicas &&
+			s.Status.CurrentRevision == s.Status.UpdateRevision, nil
+	case DAEMONSET:
+		ds, err := apps.DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if ds.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+			glog.Warningf("%s/%s uses the OnDelete update strategy, the pods restart when they are deleted", kind, name)
+			return true, nil
+		}
+		return ds.Status.ObservedGeneration >= generation &&
+			ds.Status.UpdatedNumberScheduled == ds.Status.DesiredNumberScheduled &&
+			ds.Status.NumberAvailable == ds.Status.DesiredNumberScheduled, nil
+	}
+	return false, fmt.Errorf("%s/%s can not be rollout restarted", kind, name)
+}
+
+// restartSkipPrefix starts the skip reasons of DedupeRestarts, they are reset when the plan is selected again
+const restartSkipPrefix = "rollout restart of "
+
+// DedupeRestarts keeps the first runnable rollout restart of every workload and skips the others.
+// A rollout restarts every pod of the workload, so if any of them is protected the restarts of the workload are all skipped.
+// It runs after Select, so that the restart is planned by a pod which is still selected.
+func DedupeRestarts(steps []Step, client kubernetes.Interface, protected *common.Selector) []Step {
+	planned := make(map[string]*Step)
+	for i := range steps {
+		s := &steps[i]
+		if s.Operation != OPROLLOUTRESTART || s.Workload == "" || s.Skip != "" || s.Error != "" {
+			continue
+		}
+		key := s.Namespace + "/" + s.Workload
+		if first, ok := planned[key]; ok {
+			switch {
+			case first.Error != "":
+				s.Error = first.Error
+			case first.Skip != "":
+				s.Skip = first.Skip
+			default:
+				s.Skip = fmt.Sprintf(restartSkipPrefix+"%s is planned by pod %s", s.Workload, first.Pod)
+			}
+		} else {
+			planned[key] = s
+			if protected != nil {
+				pod, err := protectedPod(s.Namespace, s.Workload, client, protected)
+				if err != nil {
+					s.Error = err.Error()
+				} else if pod != "" {
+					s.Skip = fmt.Sprintf(restartSkipPrefix+"%s would restart the protected pod %s", s.Workload, pod)
+				}
+			}
+		}
+		if s.Skip != "" {
+			glog.Warningf("Rule %s: %s %s skipped, %s", s.Rule, s.Type, s.target(), s.Skip)
+		}
+	}
+	return steps
+}
+
+// protectedPod returns the name of a protected pod of the workload, empty if none is
+func protectedPod(namespace, workload string, client kubernetes.Interface, protected *common.Selector) (string, error) {
+	pods, err := workloadPods(namespace, workload, client)
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods {
+		s := Step{Namespace: pod.Namespace, Pod: pod.Name, labels: pod.Labels}
+		if owner := metav1.GetControllerOf(&pod); owner != nil {
+			s.Owner = owner.Kind + "/" + owner.Name
+		}
+		if protectedReason(s, protected) != "" {
+			return pod.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// workloadPods returns the pods matching the selector of the workload
+func workloadPods(namespace, workload string, client kubernetes.Interface) ([]corev1.Pod, error) {
+	kind, name := splitWorkload(workload)
+	apps := client.AppsV1()
+	var selector *metav1.LabelSelector
+	var err error
+	switch kind {
+	case DEPLOYMENT:
+		var d *appsv1.Deployment
+		if d, err = apps.Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{}); err == nil {
+			selector = d.Spec.Selector
+		}
+	case STATEFULSET:
+		var s *appsv1.StatefulSet
+		if s, err = apps.StatefulSets(namespace).Get(context.TODO(), name, metav1.GetOptions{}); err == nil {
+			selector = s.Spec.Selector
+		}
+	case DAEMONSET:
+		var ds *appsv1.DaemonSet
+		if ds, err = apps.DaemonSets(namespace).Get(context.TODO(), name, metav1.GetOptions{}); err == nil {
+			selector = ds.Spec.Selector
+		}
+	default:
+		return nil, fmt.Errorf("%s can not be rollout restarted", workload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s in %s: %v", workload, namespace, err)
+	}
+	sel, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("selector of %s in %s: %v", workload, namespace, err)
+	}
+	list, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: sel.String()})
+	if err != nil {
+		return nil, fmt.Errorf("list pods of %s in %s: %v", workload, namespace, err)
+	}
+	return list.Items, nil
+}
@@ -0,0 +1,209 @@
+package recover
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func controller(kind, name string) []metav1.OwnerReference {
+	isController := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &isController}}
+}
+
+func testPod(name string, labels map[string]string, owners []metav1.OwnerReference) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels, OwnerReferences: owners}}
+}
+
+func testDeployment(name string, replicas int32, status appsv1.DeploymentStatus) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+		},
+		Status: status,
+	}
+}
+
+func TestResolveWorkload(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-5d8f", Namespace: "default", OwnerReferences: controller(DEPLOYMENT, "web")}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "orphan", Namespace: "default"}},
+	)
+	tests := []struct {
+		name     string
+		pod      *corev1.Pod
+		workload string
+		// reason is the substring of why the pod is deleted instead
+		reason string
+		err    bool
+	}{
+		{name: "deployment", pod: testPod("web-5d8f-x", nil, controller("ReplicaSet", "web-5d8f")), workload: "Deployment/web"},
+		{name: "statefulset", pod: testPod("db-0", nil, controller(STATEFULSET, "db")), workload: "StatefulSet/db"},
+		{name: "daemonset", pod: testPod("agent-x", nil, controller(DAEMONSET, "agent")), workload: "DaemonSet/agent"},
+		{name: "bare pod", pod: testPod("debug", nil, nil), reason: "bare pod"},
+		{name: "replicaset without deployment", pod: testPod("orphan-x", nil, controller("ReplicaSet", "orphan")), reason: "without Deployment"},
+		{name: "job", pod: testPod("backup-x", nil, controller("Job", "backup")), reason: "can not be rollout restarted"},
+		{name: "missing replicaset", pod: testPod("gone-x", nil, controller("ReplicaSet", "gone")), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workload, reason, err := resolveWorkload(tt.pod, client)
+			if (err != nil) != tt.err {
+				t.Fatalf("resolveWorkload() error = %v, want error %v", err, tt.err)
+			}
+			if workload != tt.workload {
+				t.Errorf("resolveWorkload() workload = %q, want %q", workload, tt.workload)
+			}
+			if !strings.Contains(reason, tt.reason) || (tt.reason == "" && reason != "") {
+				t.Errorf("resolveWorkload() reason = %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+
+	// a bare pod is deleted instead of restarted
+	s := Step{Namespace: "default", Pod: "debug", Operation: OPROLLOUTRESTART}
+	s.planRestart(testPod("debug", nil, nil), client)
+	if s.Operation != OPDELETEPOD || s.Workload != "" || !strings.Contains(s.Note, "falls back to delete") {
+		t.Errorf("planRestart() of a bare pod = %+v, want a delete", s)
+	}
+}
+
+func TestRolloutRestart(t *testing.T) {
+	done := appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2}
+	// the pod template has no annotations, the patch must add them
+	client := fake.NewSimpleClientset(testDeployment("web", 2, done), testDeployment("slow", 2, appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 1, AvailableReplicas: 1}))
+
+	if err := rolloutRestart("default", "Deployment/web", time.Minute, client); err != nil {
+		t.Fatalf("rolloutRestart() error = %v", err)
+	}
+	d, err := client.AppsV1().Deployments("default").Get(context.TODO(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]; !ok {
+		t.Errorf("pod template annotations = %v, want restartedAt", d.Spec.Template.Annotations)
+	}
+
+	err = rolloutRestart("default", "Deployment/slow", 50*time.Millisecond, client)
+	if err == nil || !strings.Contains(err.Error(), "not finished in 50ms") {
+		t.Errorf("rolloutRestart() of an unfinished rollout error = %v, want the timeout", err)
+	}
+	if err := rolloutRestart("default", "Job/backup", time.Minute, client); err == nil {
+		t.Errorf("rolloutRestart() of a Job should fail")
+	}
+}
+
+func TestRolloutDone(t *testing.T) {
+	onDelete := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       appsv1.StatefulSetSpec{UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}},
+	}
+	daemonset := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default"},
+		Status:     appsv1.DaemonSetStatus{ObservedGeneration: 2, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 2},
+	}
+	tests := []struct {
+		name       string
+		object     runtime.Object
+		kind       string
+		generation int64
+		done       bool
+		err        bool
+	}{
+		{
+			name:   "deployment available",
+			object: testDeployment("web", 2, appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2}),
+			kind:   DEPLOYMENT, generation: 2, done: true,
+		},
+		{
+			name:   "deployment with old pods",
+			object: testDeployment("web", 2, appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 2, AvailableReplicas: 2}),
+			kind:   DEPLOYMENT, generation: 2,
+		},
+		{
+			// the deadline is of the previous rollout until the restart is observed
+			name: "deployment restart not observed",
+			object: testDeployment("web", 2, appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2,
+				Conditions: []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"}}}),
+			kind: DEPLOYMENT, generation: 2,
+		},
+		{
+			name: "deployment progress deadline exceeded",
+			object: testDeployment("web", 2, appsv1.DeploymentStatus{ObservedGeneration: 2,
+				Conditions: []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"}}}),
+			kind: DEPLOYMENT, generation: 2, err: true,
+		},
+		{name: "statefulset on delete", object: onDelete, kind: STATEFULSET, generation: 2, done: true},
+		{name: "daemonset unavailable", object: daemonset, kind: DAEMONSET, generation: 2},
+		{name: "missing deployment", kind: DEPLOYMENT, generation: 1, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			if tt.object != nil {
+				client = fake.NewSimpleClientset(tt.object)
+			}
+			name := map[string]string{DEPLOYMENT: "web", STATEFULSET: "db", DAEMONSET: "agent"}[tt.kind]
+			done, err := rolloutDone(context.TODO(), "default", tt.kind, name, tt.generation, client)
+			if (err != nil) != tt.err {
+				t.Fatalf("rolloutDone() error = %v, want error %v", err, tt.err)
+			}
+			if done != tt.done {
+				t.Errorf("rolloutDone() = %v, want %v", done, tt.done)
+			}
+		})
+	}
+}
+
+func TestDedupeRestarts(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testDeployment("web", 2, appsv1.DeploymentStatus{}),
+		testDeployment("db", 2, appsv1.DeploymentStatus{}),
+		testPod("web-1", map[string]string{"app": "web"}, nil),
+		testPod("web-2", map[string]string{"app": "web"}, nil),
+		testPod("db-1", map[string]string{"app": "db"}, nil),
+		testPod("db-2", map[string]string{"app": "db", "tier": "critical"}, nil),
+	)
+	restart := func(pod, workload, skip string) Step {
+		return Step{Type: PODTYPE, Namespace: "default", Pod: pod, Workload: workload, Operation: OPROLLOUTRESTART, Skip: skip}
+	}
+	steps := DedupeRestarts([]Step{
+		// web-1 is not selected, the restart is planned by web-2
+		restart("web-1", "Deployment/web", "excluded by pods [web-1]"),
+		restart("web-2", "Deployment/web", ""),
+		restart("web-3", "Deployment/web", ""),
+		// db-2 is healthy but protected, restarting db would restart it
+		restart("db-1", "Deployment/db", ""),
+		restart("db-3", "Deployment/db", ""),
+	}, client, &common.Selector{Labels: "tier=critical"})
+
+	want := []string{
+		"excluded by pods [web-1]",
+		"",
+		"rollout restart of Deployment/web is planned by pod web-2",
+		"rollout restart of Deployment/db would restart the protected pod db-2",
+		"rollout restart of Deployment/db would restart the protected pod db-2",
+	}
+	for i, s := range steps {
+		if s.Skip != want[i] {
+			t.Errorf("step %s skip = %q, want %q", s.Pod, s.Skip, want[i])
+		}
+	}
+
+	// the workload of a protected pod can not be listed, it fails closed
+	steps = DedupeRestarts([]Step{restart("api-1", "Deployment/api", "")}, client, &common.Selector{Labels: "tier=critical"})
+	if steps[0].Error == "" {
+		t.Errorf("DedupeRestarts() of a missing workload should be an error of the step")
+	}
+}
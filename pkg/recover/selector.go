@@ -0,0 +1,156 @@
+package recover
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// criterion is a field of a selector and whether the pod matches it
+type criterion struct {
+	name    string
+	matched bool
+}
+
+// Select skips the pods not matching every criterion of the include selector of the rule,
+// matching any criterion of its exclude selector, or of the protected selector which no rule can override.
+// Other steps than pods and exec are returned as is.
+func Select(steps []Step, r common.Recover, protected *common.Selector) []Step {
+	for i := range steps {
+		s := &steps[i]
+		if (s.Type != PODTYPE && s.Type != EXECTYPE) || s.Skip != "" {
+			continue
+		}
+		s.Skip = selectReason(*s, r, protected)
+		if s.Skip == "" {
+			continue
+		}
+		glog.Warningf("Rule %s: %s %s skipped, %s", s.Rule, s.Type, s.target(), s.Skip)
+	}
+	return steps
+}
+
+// Reselect resolves the labels and the owner of the pods of a loaded plan again, they are not saved,
+// and skips the pods not selected by their rule or protected. A pod which is not found is an error of its step.
+// The rollout restarts are deduplicated again among the steps still selected.
+func (p Plan) Reselect(client kubernetes.Interface, rules []common.Rule, protected *common.Selector) Plan {
+	recovers := make(map[string]common.Recover, len(rules))
+	for _, rule := range rules {
+		recovers[rule.Name] = rule.Recover
+	}
+	steps := make([]Step, len(p.Steps))
+	copy(steps, p.Steps)
+	for i := range steps {
+		s := &steps[i]
+		if s.Operation == OPROLLOUTRESTART && strings.HasPrefix(s.Skip, restartSkipPrefix) {
+			s.Skip = ""
+		}
+		if (s.Type != PODTYPE && s.Type != EXECTYPE) || s.Skip != "" || s.Error != "" {
+			continue
+		}
+		pod, err := getPodByName(s.Pod, s.Namespace, client)
+		if err != nil {
+			s.Error = err.Error()
+			continue
+		}
+		s.labels = pod.Labels
+		s.Owner = ""
+		if owner := metav1.GetControllerOf(pod); owner != nil {
+			s.Owner = owner.Kind + "/" + owner.Name
+		}
+		Select(steps[i:i+1], recovers[s.Rule], protected)
+	}
+	return Plan{Created: p.Created, Steps: DedupeRestarts(steps, client, protected)}
+}
+
+// selectReason returns why the pod of the step is not selected, empty if it is
+func selectReason(s Step, r common.Recover, protected *common.Selector) string {
+	if reason := protectedReason(s, protected); reason != "" {
+		return reason
+	}
+	if r.Exclude != nil {
+		if names := matched(selectorCriteria(r.Exclude, s, true), true); len(names) > 0 {
+			return "excluded by " + strings.Join(names, ", ")
+		}
+	}
+	if r.Include != nil {
+		if names := matched(selectorCriteria(r.Include, s, false), false); len(names) > 0 {
+			return "not included by " + strings.Join(names, ", ")
+		}
+	}
+	return ""
+}
+
+// protectedReason returns why the pod of the step is protected, empty if it is not
+func protectedReason(s Step, protected *common.Selector) string {
+	if protected == nil {
+		return ""
+	}
+	if names := matched(selectorCriteria(protected, s, true), true); len(names) > 0 {
+		return "protected by " + strings.Join(names, ", ")
+	}
+	return ""
+}
+
+// selectorCriteria returns the criteria of the fields set in the selector.
+// An invalid pattern is matched or not as invalid, so that it fails closed.
+func selectorCriteria(sel *common.Selector, s Step, invalid bool) []criterion {
+	var criteria []criterion
+	if len(sel.Namespaces) > 0 {
+		c := criterion{name: fmt.Sprintf("namespaces %v", sel.Namespaces)}
+		for _, pattern := range sel.Namespaces {
+			ok, err := filepath.Match(pattern, s.Namespace)
+			if err != nil {
+				ok = invalid
+			}
+			c.matched = c.matched || ok
+		}
+		criteria = append(criteria, c)
+	}
+	if len(sel.Pods) > 0 {
+		c := criterion{name: fmt.Sprintf("pods %v", sel.Pods)}
+		for _, pattern := range sel.Pods {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			c.matched = c.matched || (err != nil && invalid) || (err == nil && re.MatchString(s.Pod))
+		}
+		criteria = append(criteria, c)
+	}
+	if sel.Labels != "" {
+		c := criterion{name: "labels " + sel.Labels}
+		selector, err := labels.Parse(sel.Labels)
+		if err != nil {
+			c.matched = invalid
+		} else {
+			c.matched = selector.Matches(labels.Set(s.labels))
+		}
+		criteria = append(criteria, c)
+	}
+	if len(sel.OwnerKinds) > 0 {
+		c := criterion{name: fmt.Sprintf("owner-kinds %v", sel.OwnerKinds)}
+		kind := strings.SplitN(s.Owner, "/", 2)[0]
+		for _, k := range sel.OwnerKinds {
+			c.matched = c.matched || (kind != "" && strings.EqualFold(k, kind))
+		}
+		criteria = append(criteria, c)
+	}
+	return criteria
+}
+
+// matched returns the names of the criteria which are matched or not
+func matched(criteria []criterion, isMatched bool) []string {
+	var names []string
+	for _, c := range criteria {
+		if c.matched == isMatched {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,157 @@
+package recover
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSelect(t *testing.T) {
+	step := func(namespace, pod, owner string, labels map[string]string) Step {
+		return Step{Rule: "pending-pod", Type: PODTYPE, Namespace: namespace, Pod: pod, Owner: owner, labels: labels}
+	}
+	steps := []Step{
+		step("kube-system", "coredns-1", "ReplicaSet/coredns", map[string]string{"k8s-app": "kube-dns"}),
+		step("default", "mysql-0", "StatefulSet/mysql", map[string]string{"app": "mysql"}),
+		step("default", "web-1", "ReplicaSet/web", map[string]string{"app": "web"}),
+		step("default", "agent-x", "DaemonSet/agent", nil),
+		step("monitoring", "debug", "", nil),
+		{Rule: "pending-pod", Type: SERVICETYPE, Service: "kubelet"},
+	}
+	tests := []struct {
+		name      string
+		recover   common.Recover
+		protected *common.Selector
+		// skips are the prefixes of the skip reasons of the steps, empty if the step is selected
+		skips []string
+	}{
+		{
+			name:  "all",
+			skips: []string{"", "", "", "", "", ""},
+		},
+		{
+			name:    "include namespace glob",
+			recover: common.Recover{Include: &common.Selector{Namespaces: []string{"default", "monitor*"}}},
+			skips:   []string{"not included by namespaces", "", "", "", "", ""},
+		},
+		{
+			name:    "exclude namespace glob",
+			recover: common.Recover{Exclude: &common.Selector{Namespaces: []string{"kube-*"}}},
+			skips:   []string{"excluded by namespaces", "", "", "", "", ""},
+		},
+		{
+			name:    "include owner kinds",
+			recover: common.Recover{Include: &common.Selector{OwnerKinds: []string{"replicaset", "DaemonSet"}}},
+			skips:   []string{"", "not included by owner-kinds", "", "", "not included by owner-kinds", ""},
+		},
+		{
+			name:    "include every criterion",
+			recover: common.Recover{Include: &common.Selector{Namespaces: []string{"default"}, Pods: []string{"web-.*", "mysql-0"}, Labels: "app"}},
+			skips:   []string{"not included by namespaces", "", "", "not included by pods [web-.* mysql-0], labels app", "not included by namespaces [default], pods [web-.* mysql-0], labels app", ""},
+		},
+		{
+			name: "exclude over include",
+			recover: common.Recover{
+				Include: &common.Selector{Namespaces: []string{"default"}},
+				Exclude: &common.Selector{Pods: []string{"web-[0-9]+"}},
+			},
+			skips: []string{"not included by", "", "excluded by pods", "", "not included by", ""},
+		},
+		{
+			name:      "protected over include",
+			recover:   common.Recover{Include: &common.Selector{Namespaces: []string{"*"}}},
+			protected: &common.Selector{Namespaces: []string{"kube-*"}, Labels: "app=mysql"},
+			skips:     []string{"protected by namespaces", "protected by labels app=mysql", "", "", "", ""},
+		},
+		{
+			// an invalid pattern fails closed
+			name:    "invalid patterns",
+			recover: common.Recover{Include: &common.Selector{Pods: []string{"web-("}}, Exclude: &common.Selector{Namespaces: []string{"kube-["}}},
+			skips:   []string{"excluded by", "excluded by", "excluded by", "excluded by", "excluded by", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := make([]Step, len(steps))
+			copy(input, steps)
+			for i, s := range Select(input, tt.recover, tt.protected) {
+				if (tt.skips[i] == "") != (s.Skip == "") || !strings.HasPrefix(s.Skip, tt.skips[i]) {
+					t.Errorf("step %s skip = %q, want %q", s.target(), s.Skip, tt.skips[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReselect(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testDeployment("web", 2, appsv1.DeploymentStatus{}),
+		testPod("web-1", map[string]string{"app": "web"}, controller("ReplicaSet", "web-5d8f")),
+		testPod("web-2", map[string]string{"app": "web", "tier": "critical"}, controller("ReplicaSet", "web-5d8f")),
+		testPod("db-0", map[string]string{"app": "db"}, controller(STATEFULSET, "db")),
+	)
+	restart := func(pod, skip string) Step {
+		return Step{Rule: "pending-pod", Type: PODTYPE, Namespace: "default", Pod: pod, Workload: "Deployment/web", Operation: OPROLLOUTRESTART, Skip: skip}
+	}
+	// the plan saved by --dry-run, the restart of web is planned by web-1
+	plan := Plan{Steps: []Step{
+		restart("web-1", ""),
+		restart("web-2", "rollout restart of Deployment/web is planned by pod web-1"),
+		{Rule: "pending-pod", Type: PODTYPE, Namespace: "default", Pod: "db-0", Operation: OPDELETEPOD},
+		{Rule: "pending-pod", Type: PODTYPE, Namespace: "default", Pod: "gone", Operation: OPDELETEPOD},
+		{Rule: "other", Type: PODTYPE, Namespace: "default", Pod: "web-1", Operation: OPDELETEPOD, Skip: "excluded by pods [web-1]"},
+	}}
+
+	tests := []struct {
+		name      string
+		rules     []common.Rule
+		protected *common.Selector
+		skips     []string
+	}{
+		{
+			name:  "unchanged",
+			rules: []common.Rule{{Name: "pending-pod"}},
+			skips: []string{"", "rollout restart of Deployment/web is planned by pod web-1", "", "", "excluded by pods [web-1]"},
+		},
+		{
+			name: "planning pod excluded",
+			rules: []common.Rule{{Name: "pending-pod", Recover: common.Recover{
+				Exclude: &common.Selector{Pods: []string{"web-1"}, OwnerKinds: []string{STATEFULSET}},
+			}}},
+			skips: []string{"excluded by pods [web-1]", "", "excluded by owner-kinds [StatefulSet]", "", "excluded by pods [web-1]"},
+		},
+		{
+			name:      "pod of the workload protected",
+			rules:     []common.Rule{{Name: "pending-pod"}},
+			protected: &common.Selector{Labels: "tier=critical"},
+			skips: []string{
+				"rollout restart of Deployment/web would restart the protected pod web-2",
+				"protected by labels tier=critical",
+				"", "", "excluded by pods [web-1]",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := plan.Reselect(client, tt.rules, tt.protected)
+			for i, s := range got.Steps {
+				if s.Skip != tt.skips[i] {
+					t.Errorf("step %s skip = %q, want %q", s.Pod, s.Skip, tt.skips[i])
+				}
+			}
+			if got.Steps[3].Error == "" {
+				t.Errorf("step of a missing pod should be an error")
+			}
+			if got.Steps[0].Owner != "ReplicaSet/web-5d8f" {
+				t.Errorf("owner = %q, want ReplicaSet/web-5d8f", got.Steps[0].Owner)
+			}
+			if plan.Steps[0].Owner != "" || plan.Steps[3].Error != "" {
+				t.Errorf("Reselect() changed the loaded plan")
+			}
+		})
+	}
+}
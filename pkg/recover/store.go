@@ -0,0 +1,110 @@
+package recover
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// StoreConfig is the file or the ConfigMap keeping data of the recovery across runs.
+// Approvals and limit state can share the same ConfigMap, they are kept under different keys.
+type StoreConfig struct {
+	File string `yaml:"file,omitempty"`
+	// ConfigMap is namespace/name of the ConfigMap
+	ConfigMap string `yaml:"configmap,omitempty"`
+}
+
+// blobStore loads and saves the content of a file or a key of a ConfigMap
+type blobStore interface {
+	Load() ([]byte, error)
+	Save([]byte) error
+}
+
+// open returns the store of the file or of the key of the ConfigMap, nil if none is configured
+func (c StoreConfig) open(client kubernetes.Interface, key string) (blobStore, error) {
+	switch {
+	case c.File != "":
+		return fileStore(c.File), nil
+	case c.ConfigMap != "":
+		parts := strings.SplitN(c.ConfigMap, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("configmap %q is not namespace/name", c.ConfigMap)
+		}
+		if client == nil {
+			return nil, fmt.Errorf("configmap %s requires the kube client", c.ConfigMap)
+		}
+		return &configMapStore{client: client, namespace: parts[0], name: parts[1], key: key}, nil
+	}
+	return nil, nil
+}
+
+// source is the file or the ConfigMap in errors
+func (c StoreConfig) source() string {
+	if c.File != "" {
+		return c.File
+	}
+	return "configmap " + c.ConfigMap
+}
+
+// fileStore keeps the content in a file, a missing file is empty
+type fileStore string
+
+func (f fileStore) Load() ([]byte, error) {
+	content, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (f fileStore) Save(content []byte) error {
+	return ioutil.WriteFile(string(f), content, 0644)
+}
+
+// configMapStore keeps the content in a key of a ConfigMap, created on the first save
+type configMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	key       string
+}
+
+func (c *configMapStore) Load() ([]byte, error) {
+	cm, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(context.TODO(), c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(cm.Data[c.key]), nil
+}
+
+func (c *configMapStore) Save(content []byte) error {
+	configMaps := c.client.CoreV1().ConfigMaps(c.namespace)
+	cm, err := configMaps.Get(context.TODO(), c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: c.name, Namespace: c.namespace},
+			Data:       map[string]string{c.key: string(content)},
+		}
+		_, err = configMaps.Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[c.key] = string(content)
+	_, err = configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
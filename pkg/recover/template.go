@@ -0,0 +1,74 @@
+package recover
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// shellSafe matches the strings which need no quoting in a shell command
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// ActionData is the data of the action template, every string is shell-escaped
+type ActionData struct {
+	Rule   string
+	Labels map[string]string
+	Value  string
+	Node   string
+	NodeIP string
+}
+
+// ParseAction parses the action as a Go template, a missing label is an error
+func ParseAction(action string) (*template.Template, error) {
+	return template.New("action").Option("missingkey=error").Parse(action)
+}
+
+// RenderActions renders the command of the steps running a custom action with the sample,
+// the rule and the node of their target. Steps whose template fails are set the error.
+func RenderActions(steps []Step) []Step {
+	for i := range steps {
+		s := &steps[i]
+		if (s.Operation != OPSSH && s.Operation != OPEXEC) || IsBuiltinAction(s.Type, s.Action) || !strings.Contains(s.Action, "{{") {
+			continue
+		}
+		command, err := s.renderAction()
+		if err != nil {
+			s.Error = fmt.Sprintf("render action: %v", err)
+			continue
+		}
+		s.Command = command
+	}
+	return steps
+}
+
+func (s Step) renderAction() (string, error) {
+	tmpl, err := ParseAction(s.Action)
+	if err != nil {
+		return "", err
+	}
+	data := ActionData{
+		Rule:   shellQuote(s.Rule),
+		Labels: make(map[string]string, len(s.metric)),
+		Value:  strconv.FormatFloat(s.value, 'f', -1, 64),
+		Node:   shellQuote(s.Node),
+		NodeIP: shellQuote(s.NodeIP),
+	}
+	for name, value := range s.metric {
+		data.Labels[string(name)] = shellQuote(string(value))
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// shellQuote returns the string as a single shell word, quoted if it has other characters than the safe ones
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,67 @@
+package recover
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"nginx-7d4b9c-x2x", "nginx-7d4b9c-x2x"},
+		{"10.0.0.1:9100", "10.0.0.1:9100"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"$(reboot)", "'$(reboot)'"},
+		{"x';rm -rf /;'", `'x'"'"';rm -rf /;'"'"''`},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderActions(t *testing.T) {
+	steps := []Step{
+		{
+			Rule:      "mem",
+			Type:      PODTYPE,
+			Action:    "kill -USR1 $(pidof java) && echo {{.Labels.pod}} {{.Labels.namespace}} {{.Value}} {{.Node}} {{.Rule}}",
+			Operation: OPSSH,
+			Node:      "node-1",
+			metric:    model.Metric{"pod": "app-0", "namespace": "a;reboot"},
+			value:     93.5,
+		},
+		{
+			Rule:      "mem",
+			Type:      PODTYPE,
+			Action:    "echo {{.Labels.container}}",
+			Operation: OPSSH,
+			metric:    model.Metric{"pod": "app-0"},
+		},
+		{
+			Rule:      "failed-pod",
+			Type:      PODTYPE,
+			Action:    "delete",
+			Operation: OPDELETEPOD,
+			Command:   "DELETE /api/v1/namespaces/ns/pods/app-0",
+		},
+	}
+	steps = RenderActions(steps)
+
+	want := "kill -USR1 $(pidof java) && echo app-0 'a;reboot' 93.5 node-1 mem"
+	if steps[0].Command != want || steps[0].Error != "" {
+		t.Errorf("command = %q, error %q, want %q", steps[0].Command, steps[0].Error, want)
+	}
+	if !strings.Contains(steps[1].Error, "container") {
+		t.Errorf("missing label should be an error, got %q", steps[1].Error)
+	}
+	if steps[2].Command != "DELETE /api/v1/namespaces/ns/pods/app-0" {
+		t.Errorf("builtin action should not be rendered, got %q", steps[2].Command)
+	}
+}
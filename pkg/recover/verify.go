@@ -0,0 +1,183 @@
+package recover
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// verification outcomes of the executed steps
+const (
+	RESOLVED     = "resolved"
+	STILLFAILING = "still failing"
+)
+
+// DefaultVerifyDelay is the time to wait after the recovery before re-evaluating the expr if the rule has no delay
+const DefaultVerifyDelay = time.Minute
+
+// VerifyDelay returns the delay of the verification, the default delay if not set or invalid
+func VerifyDelay(v *common.Verify) time.Duration {
+	if v == nil || v.Delay == "" {
+		return DefaultVerifyDelay
+	}
+	d, err := model.ParseDuration(v.Delay)
+	if err != nil {
+		return DefaultVerifyDelay
+	}
+	return time.Duration(d)
+}
+
+// ExecutedAt returns the time the last step of the rule was executed, zero if none of its steps was executed
+func (p Plan) ExecutedAt(rule string) time.Time {
+	var last time.Time
+	for _, s := range p.Steps {
+		if s.Rule == rule && s.executed.After(last) {
+			last = s.executed
+		}
+	}
+	return last
+}
+
+// Verify sets the outcome of the executed steps of the rule by the result of its re-evaluation.
+// A step is resolved if its target is not in the result any more: the pod or any pod of its controller,
+// the service on its instance, or any pod of the restarted workload. The result is returned with only
+// the series of the targets still failing.
+func (p *Plan) Verify(rule string, result interface{}, client kubernetes.Interface) (interface{}, error) {
+	series, err := seriesOf(result)
+	if err != nil {
+		return nil, err
+	}
+	// pods of the result, resolved only for the steps of a controller or a workload
+	pods := map[string]*corev1.Pod{}
+	podOf := func(metric model.Metric) *corev1.Pod {
+		key := string(metric["namespace"]) + "/" + string(metric["pod"])
+		if pod, ok := pods[key]; ok {
+			return pod
+		}
+		pod, err := getPodByName(string(metric["pod"]), string(metric["namespace"]), client)
+		if err != nil {
+			pod = nil
+		}
+		pods[key] = pod
+		return pod
+	}
+	workloads := map[string]string{}
+	t := seriesTarget{
+		owner: func(metric model.Metric) string {
+			if pod := podOf(metric); pod != nil {
+				if owner := metav1.GetControllerOf(pod); owner != nil {
+					return owner.Kind + "/" + owner.Name
+				}
+			}
+			return ""
+		},
+		workload: func(metric model.Metric) string {
+			key := string(metric["namespace"]) + "/" + string(metric["pod"])
+			if workload, ok := workloads[key]; ok {
+				return workload
+			}
+			var workload string
+			if pod := podOf(metric); pod != nil {
+				workload, _, _ = resolveWorkload(pod, client)
+			}
+			workloads[key] = workload
+			return workload
+		},
+	}
+
+	failing := map[model.Fingerprint]bool{}
+	for i := range p.Steps {
+		s := &p.Steps[i]
+		if s.Rule != rule || s.executed.IsZero() {
+			continue
+		}
+		s.Verify = RESOLVED
+		for _, metric := range series {
+			if s.failing(metric, t) {
+				s.Verify = STILLFAILING
+				failing[metric.Fingerprint()] = true
+			}
+		}
+	}
+	return filterResult(result, failing), nil
+}
+
+// seriesTarget resolves the controller and the workload of the pod of a series
+type seriesTarget struct {
+	owner    func(model.Metric) string
+	workload func(model.Metric) string
+}
+
+// SetVerify sets the outcome of the executed steps of the rule, only of the steps with the old outcome if it is not empty
+func (p *Plan) SetVerify(rule, old, outcome string) {
+	for i := range p.Steps {
+		s := &p.Steps[i]
+		if s.Rule == rule && !s.executed.IsZero() && (old == "" || s.Verify == old) {
+			s.Verify = outcome
+		}
+	}
+}
+
+// failing returns true if the series is of the target of the step, a pod replaced by its controller is the same target
+func (s Step) failing(metric model.Metric, t seriesTarget) bool {
+	switch {
+	case s.Type == SERVICETYPE:
+		return string(metric["name"]) == s.Service && string(metric["instance"]) == s.Instance
+	case string(metric["namespace"]) != s.Namespace:
+		return false
+	case string(metric["pod"]) == s.Pod:
+		return true
+	case s.Workload != "":
+		return t.workload(metric) == s.Workload
+	case s.Owner != "":
+		return t.owner(metric) == s.Owner
+	}
+	return false
+}
+
+// seriesOf returns the labels of every series of the query result
+func seriesOf(result interface{}) ([]model.Metric, error) {
+	var series []model.Metric
+	switch r := result.(type) {
+	case model.Vector:
+		for _, v := range r {
+			series = append(series, v.Metric)
+		}
+	case model.Matrix:
+		for _, m := range r {
+			series = append(series, m.Metric)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported result type: %v", r)
+	}
+	return series, nil
+}
+
+// filterResult returns the query result with only the series of the fingerprints
+func filterResult(result interface{}, keep map[model.Fingerprint]bool) interface{} {
+	switch r := result.(type) {
+	case model.Vector:
+		var vector model.Vector
+		for _, v := range r {
+			if keep[v.Metric.Fingerprint()] {
+				vector = append(vector, v)
+			}
+		}
+		return vector
+	case model.Matrix:
+		var matrix model.Matrix
+		for _, m := range r {
+			if keep[m.Metric.Fingerprint()] {
+				matrix = append(matrix, m)
+			}
+		}
+		return matrix
+	}
+	return result
+}
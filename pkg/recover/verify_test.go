@@ -0,0 +1,82 @@
+package recover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlanVerify(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "api-7c9d", Namespace: "default", OwnerReferences: controller(DEPLOYMENT, "api")}},
+		// the pods replacing the recovered ones
+		testPod("web-5d8f-new", nil, controller("ReplicaSet", "web-5d8f")),
+		testPod("api-7c9d-new", nil, controller("ReplicaSet", "api-7c9d")),
+		testPod("job-new", nil, controller("Job", "job")),
+	)
+	executed := time.Now()
+	steps := []Step{
+		{Rule: "r", Type: PODTYPE, Namespace: "default", Pod: "web-5d8f-old", Owner: "ReplicaSet/web-5d8f"},
+		{Rule: "r", Type: PODTYPE, Namespace: "default", Pod: "api-7c9d-old", Owner: "ReplicaSet/api-7c9d-old", Workload: "Deployment/api"},
+		{Rule: "r", Type: PODTYPE, Namespace: "default", Pod: "db-0", Owner: "StatefulSet/db"},
+		{Rule: "r", Type: PODTYPE, Namespace: "default", Pod: "debug"},
+		// the same pod name in another namespace
+		{Rule: "r", Type: PODTYPE, Namespace: "staging", Pod: "cache-0"},
+		{Rule: "r", Type: SERVICETYPE, Service: "kubelet", Instance: "10.0.0.1"},
+		{Rule: "r", Type: SERVICETYPE, Service: "kubelet", Instance: "10.0.0.2"},
+		// not executed, and of another rule
+		{Rule: "r", Type: PODTYPE, Namespace: "default", Pod: "skipped", Skip: "excluded by pods [skipped]"},
+		{Rule: "other", Type: PODTYPE, Namespace: "default", Pod: "web-5d8f-new", Owner: "ReplicaSet/web-5d8f"},
+	}
+	for i := range steps[:7] {
+		steps[i].executed = executed
+	}
+	steps[8].executed = executed
+	plan := Plan{Steps: steps}
+
+	sample := func(labels ...string) *model.Sample {
+		metric := model.Metric{}
+		for i := 0; i < len(labels); i += 2 {
+			metric[model.LabelName(labels[i])] = model.LabelValue(labels[i+1])
+		}
+		return &model.Sample{Metric: metric, Value: 1}
+	}
+	result := model.Vector{
+		sample("namespace", "default", "pod", "web-5d8f-new"),
+		sample("namespace", "default", "pod", "api-7c9d-new"),
+		sample("namespace", "default", "pod", "job-new"),
+		sample("namespace", "production", "pod", "cache-0"),
+		sample("name", "kubelet", "instance", "10.0.0.2"),
+	}
+	got, err := plan.Verify("r", result, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{STILLFAILING, STILLFAILING, RESOLVED, RESOLVED, RESOLVED, RESOLVED, STILLFAILING, "", ""}
+	for i, s := range plan.Steps {
+		if s.Verify != want[i] {
+			t.Errorf("step %s verify = %q, want %q", s.target(), s.Verify, want[i])
+		}
+	}
+	// only the series of the targets still failing are escalated
+	vector := got.(model.Vector)
+	if len(vector) != 3 || vector[0] != result[0] || vector[1] != result[1] || vector[2] != result[4] {
+		t.Errorf("Verify() = %v, want the series of web, api and kubelet on 10.0.0.2", vector)
+	}
+
+	plan.SetVerify("r", STILLFAILING, STILLFAILING+", escalated to delete")
+	if plan.Steps[0].Verify != STILLFAILING+", escalated to delete" || plan.Steps[2].Verify != RESOLVED {
+		t.Errorf("SetVerify() should only change the steps still failing")
+	}
+	if at := plan.ExecutedAt("r"); !at.Equal(executed) {
+		t.Errorf("ExecutedAt() = %v, want %v", at, executed)
+	}
+	if _, err := plan.Verify("r", model.Scalar{}, client); err == nil {
+		t.Errorf("Verify() of a scalar should fail")
+	}
+}
@@ -2,49 +2,84 @@ package result
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/longxiucai/patrol-tools/pkg/common"
 	"github.com/longxiucai/patrol-tools/pkg/recover"
 
 	"github.com/golang/glog"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type ResultList []Result
 
 type Result struct {
 	common.Rule
+	Datasource string
 	PromResult interface{}
 }
 
-func (rl ResultList) RunRecover(client kubernetes.Interface, sshconfig *common.SSHCONFIG) error {
+// Plan resolves the recovery of every result with recover enabled, nothing is changed.
+// The pods not selected by the rule or protected are skipped, then the rollout restarts are deduplicated.
+func (rl ResultList) Plan(client kubernetes.Interface, sshconfig *common.SSHCONFIG, protected *common.Selector) (recover.Plan, error) {
+	plan := recover.Plan{Created: time.Now()}
 	for _, result := range rl {
-		if result.Recover.Enable {
-			switch result.Recover.RecoveryType {
-			case "service":
-				esl := recover.NewServiceRecover(result.PromResult)
-				if esl == nil {
-					glog.Error("NewServiceRecover Error")
-					return fmt.Errorf("NewServiceRecover Error")
-				}
-				err := esl.Recover(client, sshconfig, result.Recover.Action)
-				if err != nil {
-					return err
-				}
-			case "pod":
-				epl := recover.NewPodRecover(result.PromResult)
-				if epl == nil {
-					glog.Error("NewPodRecover Error")
-					return fmt.Errorf("NewPodRecover Error")
-				}
-				err := epl.Recover(client, sshconfig, result.Recover.Action)
-				if err != nil {
-					return err
-				}
-			default:
-				return fmt.Errorf("unsupported type: %v", result.Recover.RecoveryType)
-			}
+		if !result.Recover.Enable {
+			continue
 		}
+		steps, err := result.plan(result.Recover.Action, client, sshconfig, protected)
+		if err != nil {
+			return plan, err
+		}
+		plan.Steps = append(plan.Steps, steps...)
+	}
+	plan.Steps = recover.DedupeRestarts(plan.Steps, client, protected)
+	return plan, nil
+}
+
+// plan resolves the action on the targets of the result, the pods not selected by the rule or protected are skipped
+func (result Result) plan(action string, client kubernetes.Interface, sshconfig *common.SSHCONFIG, protected *common.Selector) ([]recover.Step, error) {
+	var ri recover.RecoverInterface
+	switch result.Recover.RecoveryType {
+	case recover.SERVICETYPE:
+		ri = recover.NewServiceRecover(result.PromResult)
+		if ri == nil {
+			glog.Error("NewServiceRecover Error")
+			return nil, fmt.Errorf("NewServiceRecover Error")
+		}
+	case recover.EXECTYPE:
+		ri = recover.NewExecRecover(result.PromResult, result.Recover.Container)
+		if ri == nil {
+			glog.Error("NewExecRecover Error")
+			return nil, fmt.Errorf("NewExecRecover Error")
+		}
+	case recover.PODTYPE:
+		ri = recover.NewPodRecover(result.PromResult)
+		if ri == nil {
+			glog.Error("NewPodRecover Error")
+			return nil, fmt.Errorf("NewPodRecover Error")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type: %v", result.Recover.RecoveryType)
+	}
+	steps := ri.Plan(client, sshconfig, action)
+	for i := range steps {
+		steps[i].Rule = result.Name
+		steps[i].Timeout = result.Recover.Timeout
+		steps[i].EvictTimeout = result.Recover.EvictTimeout
+		steps[i].GracePeriod = result.Recover.GracePeriod
+	}
+	steps = recover.RenderActions(steps)
+	return recover.Select(steps, result.Recover, protected), nil
+}
+
+// RunRecover plans the recovery of the results and executes every step, a failed target does not stop the others.
+// The summary of the steps is returned, the error is only of the planning. The config of the client streams the commands of exec.
+func (rl ResultList) RunRecover(client kubernetes.Interface, config *rest.Config, sshconfig *common.SSHCONFIG, protected *common.Selector) (recover.Summary, error) {
+	plan, err := rl.Plan(client, sshconfig, protected)
+	if err != nil {
+		return recover.Summary{}, err
 	}
-	return nil
+	return plan.Execute(client, config, sshconfig, nil), nil
 }
@@ -0,0 +1,98 @@
+package result
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/recover"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Evaluator re-evaluates the rule now, returning the query result of all of its datasources
+type Evaluator func(rule common.Rule) (interface{}, error)
+
+// Verify re-evaluates every rule with verify once the delay since its last executed step is over,
+// and sets the outcome of its executed steps. The targets still failing are planned with the escalate action
+// of the rule, the returned plan is empty if nothing is escalated.
+func (rl ResultList) Verify(plan *recover.Plan, evaluate Evaluator, client kubernetes.Interface, sshconfig *common.SSHCONFIG, protected *common.Selector) (recover.Plan, error) {
+	escalation := recover.Plan{Created: time.Now()}
+	type verification struct {
+		result Result
+		at     time.Time
+	}
+	var verifications []verification
+	seen := map[string]bool{}
+	for _, result := range rl {
+		if !result.Recover.Enable || result.Recover.Verify == nil || seen[result.Name] {
+			continue
+		}
+		seen[result.Name] = true
+		executed := plan.ExecutedAt(result.Name)
+		if executed.IsZero() {
+			continue
+		}
+		verifications = append(verifications, verification{result: result, at: executed.Add(recover.VerifyDelay(result.Recover.Verify))})
+	}
+	sort.SliceStable(verifications, func(i, j int) bool { return verifications[i].at.Before(verifications[j].at) })
+
+	for _, v := range verifications {
+		rule := v.result.Rule
+		if wait := time.Until(v.at); wait > 0 {
+			glog.Infof("Verifying rule %s in %s", rule.Name, wait.Round(time.Second))
+			time.Sleep(wait)
+		}
+		promResult, err := evaluate(rule)
+		if err == nil {
+			promResult, err = plan.Verify(rule.Name, promResult, client)
+		}
+		if err != nil {
+			glog.Errorf("Verify rule %s: %v", rule.Name, err)
+			plan.SetVerify(rule.Name, "", fmt.Sprintf("verify error: %v", err))
+			continue
+		}
+		resolved, failing := countVerify(*plan, rule.Name)
+		glog.Infof("Rule %s verified: %d resolved, %d still failing", rule.Name, resolved, failing)
+		escalate := rule.Recover.Verify.Escalate
+		if escalate == "" || failing == 0 {
+			continue
+		}
+		steps, err := Result{Rule: rule, Datasource: v.result.Datasource, PromResult: promResult}.plan(escalate, client, sshconfig, protected)
+		if err != nil {
+			return escalation, fmt.Errorf("escalate rule %s: %v", rule.Name, err)
+		}
+		for i := range steps {
+			steps[i].Note = appendNote(steps[i].Note, "escalated from "+rule.Recover.Action)
+		}
+		plan.SetVerify(rule.Name, recover.STILLFAILING, recover.STILLFAILING+", escalated to "+escalate)
+		escalation.Steps = append(escalation.Steps, steps...)
+	}
+	escalation.Steps = recover.DedupeRestarts(escalation.Steps, client, protected)
+	return escalation, nil
+}
+
+// countVerify returns the number of the resolved and the still failing steps of the rule
+func countVerify(plan recover.Plan, rule string) (resolved, failing int) {
+	for _, s := range plan.Steps {
+		if s.Rule != rule {
+			continue
+		}
+		switch s.Verify {
+		case recover.RESOLVED:
+			resolved++
+		case recover.STILLFAILING:
+			failing++
+		}
+	}
+	return resolved, failing
+}
+
+func appendNote(note, s string) string {
+	if note == "" {
+		return s
+	}
+	return note + ", " + s
+}
@@ -0,0 +1,78 @@
+package result
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/recover"
+
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestVerifyEscalation(t *testing.T) {
+	isController := true
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &isController}}}}
+	}
+	client := fake.NewSimpleClientset(pod("db-0"), &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "debug", Namespace: "default"}})
+	sample := func(name string) *model.Sample {
+		return &model.Sample{Metric: model.Metric{"namespace": "default", "pod": model.LabelValue(name)}, Value: 1}
+	}
+	rule := common.Rule{Name: "pending-pod", Recover: common.Recover{
+		Enable:       true,
+		RecoveryType: recover.PODTYPE,
+		Action:       "delete",
+		Cooldown:     "1h",
+		Verify:       &common.Verify{Delay: "1ms", Escalate: "evict"},
+	}}
+	rl := ResultList{{Rule: rule, PromResult: model.Vector{sample("db-0"), sample("debug")}}}
+
+	limiter, err := recover.NewLimiter(recover.StoreConfig{File: filepath.Join(t.TempDir(), "state.json")}, client, []common.Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := rl.Plan(client, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan = limiter.Apply(plan, client)
+	if summary := plan.Execute(client, nil, nil, limiter); summary.Success != 2 {
+		t.Fatalf("Execute() = %s, want 2 succeeded", summary)
+	}
+	// the StatefulSet recreates db-0 with the same name, still failing, the bare pod debug is resolved
+	if _, err := client.CoreV1().Pods("default").Create(context.TODO(), pod("db-0"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	evaluate := func(r common.Rule) (interface{}, error) {
+		return model.Vector{sample("db-0"), {Metric: model.Metric{"namespace": "default", "pod": "web-0"}, Value: 1}}, nil
+	}
+	escalation, err := rl.Verify(&plan, evaluate, client, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := plan.Steps[0].Verify; v != recover.STILLFAILING+", escalated to evict" {
+		t.Errorf("db-0 verify = %q, want still failing and escalated", v)
+	}
+	if v := plan.Steps[1].Verify; v != recover.RESOLVED {
+		t.Errorf("debug verify = %q, want resolved", v)
+	}
+	if len(escalation.Steps) != 1 {
+		t.Fatalf("escalation = %v, want only db-0", escalation.Steps)
+	}
+	s := escalation.Steps[0]
+	if s.Pod != "db-0" || s.Operation != recover.OPEVICTPOD || !strings.Contains(s.Note, "escalated from delete") {
+		t.Errorf("escalation step = %+v, want the eviction of db-0", s)
+	}
+	// db-0 was recovered by this run, its escalation is not in cooldown
+	if skip := limiter.Apply(escalation, client).Steps[0].Skip; skip != "" {
+		t.Errorf("escalation of db-0 skipped: %s", skip)
+	}
+}
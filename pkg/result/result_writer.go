@@ -30,12 +30,14 @@ type ResultOptions struct {
 	OutPutTime       time.Time
 }
 
-func (rl ResultList) Write(op, format string, noheders bool) error {
+// Write writes the results into the output path, now is the time in the file names.
+// The timestamps of the results are rendered in the timezone of now.
+func (rl ResultList) Write(op, format string, noheders bool, now time.Time) error {
 	r := ResultWriter{
 		Options: ResultOptions{
 			OutputPath:       op,                      //  ./result/20231106-1530/
 			OutputFilePrefix: common.OUTPUTFILEPREFIX, //promql_prometheus_data
-			OutPutTime:       time.Now(),
+			OutPutTime:       now,
 		},
 	}
 	err := r.WriteResult(format, noheders, rl)
@@ -60,12 +62,12 @@ func (w *ResultWriter) WriteResult(format string, noHeaders bool, rl ResultList)
 	for _, res := range rl {
 		switch r := res.PromResult.(type) {
 		case model.Vector:
-			if err := w.WriteVectorResult(r, res.Rule, format, noHeaders, excel); err != nil {
+			if err := w.WriteVectorResult(r, res.Rule, res.Datasource, format, noHeaders, excel); err != nil {
 				glog.Error(err)
 				return err
 			}
 		case model.Matrix:
-			if err := w.WriteMatrixResult(r, res.Rule, format, noHeaders); err != nil {
+			if err := w.WriteMatrixResult(r, res.Rule, res.Datasource, format, noHeaders); err != nil {
 				glog.Error(err)
 				return err
 			}
@@ -99,19 +101,23 @@ func (w *ResultWriter) WriteResult(format string, noHeaders bool, rl ResultList)
 }
 
 // WriteVectorResult 方法用于处理 Vector 处理 VectorResult输出到适当的位置
-func (w *ResultWriter) WriteVectorResult(res model.Vector, rule common.Rule, format string, noHeaders bool, excel common.ExcelFile) error {
+func (w *ResultWriter) WriteVectorResult(res model.Vector, rule common.Rule, datasource, format string, noHeaders bool, excel common.ExcelFile) error {
 	v := writer.VectorResult{
-		Vector: res,
-		Rule:   rule,
+		Vector:     res,
+		Rule:       rule,
+		Datasource: datasource,
+		Location:   w.Options.OutPutTime.Location(),
 	}
 	return writer.WriteVector(&v, format, noHeaders, excel, &w.ResultBuffer.JsonResultBuf, &w.ResultBuffer.CsvResultBuf)
 }
 
 // WriteMatrixResult方法用于处理 Matrix 处理 MatrixResult输出到适当的位置
-func (w *ResultWriter) WriteMatrixResult(res model.Matrix, rule common.Rule, format string, noHeaders bool) error {
+func (w *ResultWriter) WriteMatrixResult(res model.Matrix, rule common.Rule, datasource, format string, noHeaders bool) error {
 	m := writer.MatrixResult{
-		Matrix: res,
-		Rule:   rule,
+		Matrix:     res,
+		Rule:       rule,
+		Datasource: datasource,
+		Location:   w.Options.OutPutTime.Location(),
 	}
 	return writer.WriteMatrix(&m, format, noHeaders, &w.ResultBuffer.JsonResultBuf, &w.ResultBuffer.CsvResultBuf)
 }
@@ -0,0 +1,59 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/longxiucai/patrol-tools/pkg/clients"
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var prometheusRuleResource = schema.GroupVersionResource{
+	Group:    "monitoring.coreos.com",
+	Version:  "v1",
+	Resource: "prometheusrules",
+}
+
+// PrometheusRuleSource selects the PrometheusRule objects to import
+type PrometheusRuleSource struct {
+	Enable bool `yaml:"enable"`
+	// Namespace to list, all namespaces if empty
+	Namespace string `yaml:"namespace"`
+	// Selector is a kubernetes label selector
+	Selector string `yaml:"selector"`
+}
+
+// List converts the alerting rules of the selected PrometheusRule objects to patrol rules
+func (s PrometheusRuleSource) List(cb *clients.Builder) ([]common.Rule, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("kube client is required to list PrometheusRule, check the kubeconfig")
+	}
+	client := cb.DynamicClientOrDie(common.NAME)
+	list, err := client.Resource(prometheusRuleResource).Namespace(s.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: s.Selector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list PrometheusRule error: %v", err)
+	}
+
+	var rules []common.Rule
+	for _, item := range list.Items {
+		spec, ok := item.Object["spec"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var groups RuleGroups
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &groups); err != nil {
+			return nil, fmt.Errorf("PrometheusRule %s/%s: %v", item.GetNamespace(), item.GetName(), err)
+		}
+		crRules := groups.ToRules()
+		glog.V(4).Infof("Imported %d rules from PrometheusRule %s/%s", len(crRules), item.GetNamespace(), item.GetName())
+		rules = append(rules, crRules...)
+	}
+	return rules, nil
+}
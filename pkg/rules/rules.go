@@ -0,0 +1,154 @@
+// rules imports prometheus alerting rules as patrol rules
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/longxiucai/patrol-tools/pkg/clients"
+	"github.com/longxiucai/patrol-tools/pkg/common"
+
+	"github.com/golang/glog"
+	"github.com/imdario/mergo"
+	"gopkg.in/yaml.v2"
+)
+
+// ImportConfig is the rules import section of the config file
+type ImportConfig struct {
+	// RuleFiles are prometheus rule files, glob patterns are supported
+	RuleFiles []string `yaml:"rule-files"`
+	// PrometheusRules lists PrometheusRule objects through the kube client
+	PrometheusRules PrometheusRuleSource `yaml:"prometheus-rules"`
+	// Overlay is a file with patrol rules that are merged into the imported rules by name
+	Overlay string `yaml:"rules-overlay"`
+}
+
+// RuleGroups is the content of a prometheus rule file, or the spec of a PrometheusRule
+type RuleGroups struct {
+	Groups []RuleGroup `yaml:"groups" json:"groups"`
+}
+
+type RuleGroup struct {
+	Name  string      `yaml:"name" json:"name"`
+	Rules []AlertRule `yaml:"rules" json:"rules"`
+}
+
+// AlertRule is a prometheus alerting or recording rule
+type AlertRule struct {
+	Alert       string            `yaml:"alert" json:"alert"`
+	Record      string            `yaml:"record" json:"record"`
+	Expr        string            `yaml:"expr" json:"expr"`
+	For         string            `yaml:"for" json:"for"`
+	Labels      map[string]string `yaml:"labels" json:"labels"`
+	Annotations map[string]string `yaml:"annotations" json:"annotations"`
+}
+
+// overlayConfig is the content of the overlay file
+type overlayConfig struct {
+	Rules []common.Rule `yaml:"rules"`
+}
+
+// Load imports the rules of the rule files and the PrometheusRule objects, then applies the overlay.
+// cb is only used when PrometheusRules is enabled.
+func (c *ImportConfig) Load(cb *clients.Builder) ([]common.Rule, error) {
+	var rules []common.Rule
+	for _, pattern := range c.RuleFiles {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule files %s: %v", pattern, err)
+		}
+		if len(files) == 0 {
+			glog.Warningf("No rule file matches %s", pattern)
+		}
+		for _, file := range files {
+			fileRules, err := LoadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, fileRules...)
+		}
+	}
+
+	if c.PrometheusRules.Enable {
+		crRules, err := c.PrometheusRules.List(cb)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, crRules...)
+	}
+
+	if c.Overlay != "" {
+		var err error
+		rules, err = ApplyOverlayFile(rules, c.Overlay)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rules) > 0 {
+		glog.Infof("Imported %d alerting rules", len(rules))
+	}
+	return rules, nil
+}
+
+// LoadFile converts the alerting rules of a prometheus rule file to patrol rules
+func LoadFile(file string) ([]common.Rule, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var groups RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("rule file %s: %v", file, err)
+	}
+	return groups.ToRules(), nil
+}
+
+// ToRules converts every alerting rule to a patrol rule, recording rules are skipped
+func (g RuleGroups) ToRules() []common.Rule {
+	var rules []common.Rule
+	for _, group := range g.Groups {
+		for _, r := range group.Rules {
+			if r.Alert == "" {
+				continue
+			}
+			rules = append(rules, common.Rule{
+				Name:        r.Alert,
+				Expr:        r.Expr,
+				For:         r.For,
+				Severity:    r.Labels["severity"],
+				Annotations: r.Annotations,
+			})
+		}
+	}
+	return rules
+}
+
+// ApplyOverlayFile merges the rules of the overlay file into the rules with the same name,
+// e.g. to attach recover blocks to imported rules
+func ApplyOverlayFile(rules []common.Rule, file string) ([]common.Rule, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var overlay overlayConfig
+	if err := yaml.Unmarshal(content, &overlay); err != nil {
+		return nil, fmt.Errorf("rules overlay %s: %v", file, err)
+	}
+	for _, o := range overlay.Rules {
+		found := false
+		for i := range rules {
+			if rules[i].Name != o.Name {
+				continue
+			}
+			found = true
+			if err := mergo.Merge(&rules[i], o, mergo.WithOverride); err != nil {
+				return nil, err
+			}
+		}
+		if !found {
+			glog.Warningf("Rules overlay %s: rule %s not found in imported rules", file, o.Name)
+		}
+	}
+	return rules, nil
+}
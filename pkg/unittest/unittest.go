@@ -0,0 +1,318 @@
+// unittest evaluates the patrol rules against synthetic series, like promtool test rules
+package unittest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/longxiucai/patrol-tools/pkg/common"
+	"github.com/longxiucai/patrol-tools/pkg/engine"
+	"github.com/longxiucai/patrol-tools/pkg/promql"
+	"github.com/longxiucai/patrol-tools/pkg/recover"
+	"github.com/longxiucai/patrol-tools/pkg/rules"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v2"
+)
+
+// testDatasource is the name of the datasource of the synthetic series
+const testDatasource = "test"
+
+// TestFile is the content of a test file
+type TestFile struct {
+	// Config is the patrol config file with the rules, relative to the test file
+	Config string      `yaml:"config"`
+	Tests  []TestGroup `yaml:"tests"`
+}
+
+// TestGroup is a set of input series and the rule tests evaluated against them
+type TestGroup struct {
+	Name        string         `yaml:"name"`
+	Interval    model.Duration `yaml:"interval"`
+	InputSeries []Series       `yaml:"input_series"`
+	RuleTests   []RuleTest     `yaml:"rule_tests"`
+}
+
+// Series is an input series in promtool notation, e.g. values: '1+1x10 _ stale'
+type Series struct {
+	Series string `yaml:"series"`
+	Values string `yaml:"values"`
+}
+
+// RuleTest asserts the findings of a rule at the eval time
+type RuleTest struct {
+	EvalTime   model.Duration `yaml:"eval_time"`
+	Rule       string         `yaml:"rule"`
+	ExpSamples []Sample       `yaml:"exp_samples"`
+	ExpTargets []Target       `yaml:"exp_targets"`
+}
+
+// Sample is an expected finding
+type Sample struct {
+	Labels string  `yaml:"labels"`
+	Value  float64 `yaml:"value"`
+}
+
+// Target is an expected recovery target, a pod or a service
+type Target struct {
+	Pod       string `yaml:"pod,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+	Service   string `yaml:"service,omitempty"`
+	Instance  string `yaml:"instance,omitempty"`
+}
+
+// LoadRules loads the rules of the config file and the rules it imports from rule files,
+// PrometheusRule objects are not imported
+func LoadRules(configFile string) ([]common.Rule, error) {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Rules              []common.Rule `yaml:"rules"`
+		rules.ImportConfig `yaml:",inline"`
+	}
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %v", configFile, err)
+	}
+	if cfg.PrometheusRules.Enable {
+		glog.Warningf("Rules of PrometheusRule objects are not tested")
+		cfg.PrometheusRules.Enable = false
+	}
+	imported, err := cfg.Load(nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(cfg.Rules, imported...), nil
+}
+
+// RunFile runs the tests of the test file and returns the failures.
+// defaultConfig is used if the test file has no config.
+func RunFile(file, defaultConfig string) []error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []error{err}
+	}
+	var tf TestFile
+	if err := yaml.UnmarshalStrict(content, &tf); err != nil {
+		return []error{err}
+	}
+	configFile := defaultConfig
+	if tf.Config != "" {
+		configFile = tf.Config
+		if !filepath.IsAbs(configFile) {
+			configFile = filepath.Join(filepath.Dir(file), configFile)
+		}
+	}
+	ruleList, err := LoadRules(configFile)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, tg := range tf.Tests {
+		errs = append(errs, tg.test(ruleList)...)
+	}
+	return errs
+}
+
+// loadString returns the series in the promql test load command notation
+func (tg TestGroup) loadString() string {
+	interval := time.Duration(tg.Interval)
+	if interval == 0 {
+		interval = time.Minute
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "load %s\n", model.Duration(interval))
+	for _, s := range tg.InputSeries {
+		fmt.Fprintf(&b, "  %s %s\n", s.Series, s.Values)
+	}
+	return b.String()
+}
+
+func (tg TestGroup) test(ruleList []common.Rule) []error {
+	// the series start at the unix epoch, eval times are relative to it
+	mint := time.Unix(0, 0).UTC()
+	var maxEvalTime model.Duration
+	for _, rt := range tg.RuleTests {
+		if rt.EvalTime > maxEvalTime {
+			maxEvalTime = rt.EvalTime
+		}
+	}
+	client, closeFn, err := engine.Load(tg.loadString(), mint.Add(time.Duration(maxEvalTime)))
+	if err != nil {
+		return []error{fmt.Errorf("group %s: %v", tg.Name, err)}
+	}
+	defer closeFn()
+
+	var errs []error
+	for _, rt := range tg.RuleTests {
+		if err := rt.test(ruleList, client, mint); err != nil {
+			errs = append(errs, fmt.Errorf("group: %s, rule: %s, time: %s,\n%v", tg.Name, rt.Rule, rt.EvalTime, err))
+		}
+	}
+	return errs
+}
+
+func (rt RuleTest) test(ruleList []common.Rule, client promql.Client, mint time.Time) error {
+	var rule *common.Rule
+	for i := range ruleList {
+		if ruleList[i].Name == rt.Rule {
+			rule = &ruleList[i]
+			break
+		}
+	}
+	if rule == nil {
+		return fmt.Errorf("    rule %s not found", rt.Rule)
+	}
+	testRule := *rule
+	testRule.Datasource = testDatasource
+
+	p := promql.PromQL{
+		Rules:           []common.Rule{testRule},
+		Datasources:     []promql.Datasource{{Name: testDatasource, Client: client}},
+		Time:            mint.Add(time.Duration(rt.EvalTime)),
+		TimeoutDuration: time.Minute,
+	}
+	results, warnings, err := p.Run()
+	if err != nil {
+		return fmt.Errorf("    %v", err)
+	}
+	if len(warnings) > 0 {
+		return fmt.Errorf("    warnings: %v", warnings)
+	}
+	vector, ok := results[0].PromResult.(model.Vector)
+	if !ok {
+		return fmt.Errorf("    unsupported result type %T", results[0].PromResult)
+	}
+
+	var msgs []string
+	expSamples, err := parseSamples(rt.ExpSamples)
+	if err != nil {
+		return fmt.Errorf("    %v", err)
+	}
+	gotSamples := make([]Sample, 0, len(vector))
+	for _, s := range vector {
+		gotSamples = append(gotSamples, Sample{Labels: s.Metric.String(), Value: float64(s.Value)})
+	}
+	sortSamples(expSamples)
+	sortSamples(gotSamples)
+	if !samplesEqual(expSamples, gotSamples) {
+		msgs = append(msgs, fmt.Sprintf("    exp samples: %s\n    got samples: %s", formatSamples(expSamples), formatSamples(gotSamples)))
+	}
+
+	if rule.Recover.RecoveryType != "" || len(rt.ExpTargets) > 0 {
+		gotTargets, err := getTargets(rule.Recover.RecoveryType, vector)
+		if err != nil {
+			return fmt.Errorf("    %v", err)
+		}
+		expTargets := append([]Target(nil), rt.ExpTargets...)
+		sortTargets(expTargets)
+		sortTargets(gotTargets)
+		if !targetsEqual(expTargets, gotTargets) {
+			msgs = append(msgs, fmt.Sprintf("    exp targets: %+v\n    got targets: %+v", expTargets, gotTargets))
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+// parseSamples normalizes the labels of the expected samples
+func parseSamples(samples []Sample) ([]Sample, error) {
+	parsed := make([]Sample, 0, len(samples))
+	for _, s := range samples {
+		lset, err := parser.ParseMetric(s.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("labels %s: %v", s.Labels, err)
+		}
+		metric := make(model.Metric, lset.Len())
+		lset.Range(func(l labels.Label) {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		})
+		parsed = append(parsed, Sample{Labels: metric.String(), Value: s.Value})
+	}
+	return parsed, nil
+}
+
+// getTargets returns the recovery targets that recover picks from the result
+func getTargets(recoveryType string, vector model.Vector) ([]Target, error) {
+	errList, err := recover.GetErrorList(recoveryType, vector)
+	if err != nil {
+		return nil, err
+	}
+	var targets []Target
+	switch l := errList.(type) {
+	case recover.ErrorPodList:
+		for _, p := range l {
+			targets = append(targets, Target{Pod: p.PodName, Namespace: p.PodNameSpace, Instance: p.Instance})
+		}
+	case recover.ErrorServiceList:
+		for _, s := range l {
+			targets = append(targets, Target{Service: s.ServiceName, Pod: s.PodName, Instance: s.Instance})
+		}
+	}
+	return targets, nil
+}
+
+func sortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Labels < samples[j].Labels
+	})
+}
+
+func samplesEqual(exp, got []Sample) bool {
+	if len(exp) != len(got) {
+		return false
+	}
+	for i := range exp {
+		if exp[i].Labels != got[i].Labels || !floatEqual(exp[i].Value, got[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// floatEqual compares the values with a small relative tolerance for float arithmetic
+func floatEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	const epsilon = 1e-9
+	return math.Abs(a-b) <= epsilon*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+func formatSamples(samples []Sample) string {
+	s := make([]string, 0, len(samples))
+	for _, sample := range samples {
+		s = append(s, fmt.Sprintf("%s %v", sample.Labels, sample.Value))
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func sortTargets(targets []Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		return fmt.Sprint(targets[i]) < fmt.Sprint(targets[j])
+	})
+}
+
+func targetsEqual(exp, got []Target) bool {
+	if len(exp) != len(got) {
+		return false
+	}
+	for i := range exp {
+		if exp[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package unittest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+rules:
+  - name: pending-pod
+    expr: kube_pod_status_phase{phase="Pending"} > 0
+    for: 5m
+    recover:
+      enable: true
+      type: pod
+      action: delete
+`
+
+func TestRunFile(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "patrol.yaml")
+	if err := ioutil.WriteFile(config, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		test string
+		// errors are the substrings of the expected failures, nil if the tests pass
+		errors []string
+	}{
+		{
+			name: "pass",
+			test: `
+tests:
+  - name: pending
+    input_series:
+      - series: 'kube_pod_status_phase{namespace="default",pod="nginx-0",phase="Pending"}'
+        values: '1x10'
+      - series: 'kube_pod_status_phase{namespace="default",pod="nginx-1",phase="Pending"}'
+        values: '0x10'
+    rule_tests:
+      - eval_time: 2m
+        rule: pending-pod
+      - eval_time: 10m
+        rule: pending-pod
+        exp_samples:
+          - labels: 'kube_pod_status_phase{namespace="default",pod="nginx-0",phase="Pending",patrol_firing_for="10m"}'
+            value: 1
+        exp_targets:
+          - pod: nginx-0
+            namespace: default
+`,
+		},
+		{
+			name: "failing sample and target",
+			test: `
+tests:
+  - name: pending
+    input_series:
+      - series: 'kube_pod_status_phase{namespace="default",pod="nginx-0",phase="Pending"}'
+        values: '1x10'
+    rule_tests:
+      - eval_time: 10m
+        rule: pending-pod
+        exp_samples:
+          - labels: 'kube_pod_status_phase{namespace="default",pod="nginx-0",phase="Pending",patrol_firing_for="10m"}'
+            value: 2
+        exp_targets:
+          - pod: nginx-1
+            namespace: default
+`,
+			errors: []string{"exp samples", "exp targets"},
+		},
+		{
+			name: "unexpected finding",
+			test: `
+tests:
+  - name: pending
+    input_series:
+      - series: 'kube_pod_status_phase{namespace="default",pod="nginx-0",phase="Pending"}'
+        values: '1x10'
+    rule_tests:
+      - eval_time: 10m
+        rule: pending-pod
+`,
+			errors: []string{"got samples: [kube_pod_status_phase"},
+		},
+		{
+			name: "unknown rule",
+			test: `
+tests:
+  - name: pending
+    rule_tests:
+      - eval_time: 1m
+        rule: missing
+`,
+			errors: []string{"rule missing not found"},
+		},
+		{
+			name: "malformed series",
+			test: `
+tests:
+  - name: pending
+    input_series:
+      - series: 'kube_pod_status_phase{namespace="default"'
+        values: '1x10'
+    rule_tests:
+      - eval_time: 1m
+        rule: pending-pod
+`,
+			errors: []string{"group pending"},
+		},
+		{
+			name: "malformed values",
+			test: `
+tests:
+  - name: pending
+    input_series:
+      - series: 'kube_pod_status_phase{namespace="default"}'
+        values: '1 x 10'
+    rule_tests:
+      - eval_time: 1m
+        rule: pending-pod
+`,
+			errors: []string{"group pending"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".yaml")
+			if err := ioutil.WriteFile(file, []byte(tt.test), 0644); err != nil {
+				t.Fatal(err)
+			}
+			errs := RunFile(file, config)
+			var msgs []string
+			for _, err := range errs {
+				msgs = append(msgs, err.Error())
+			}
+			got := strings.Join(msgs, "\n")
+			if len(tt.errors) == 0 && len(errs) > 0 {
+				t.Fatalf("RunFile() failed: %s", got)
+			}
+			if len(tt.errors) > 0 && len(errs) == 0 {
+				t.Fatalf("RunFile() passed, want failures %q", tt.errors)
+			}
+			for _, want := range tt.errors {
+				if !strings.Contains(got, want) {
+					t.Errorf("RunFile() failures %s, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// timeexpr parses the time expressions of the --time, --start and --end flags
+package timeexpr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	// the timezone database is embedded for hosts without /usr/share/zoneinfo
+	_ "time/tzdata"
+
+	"github.com/prometheus/common/model"
+)
+
+// localLayouts are the layouts of times without offset, parsed in the timezone
+var localLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// clockLayouts are the layouts of the time of day after today or yesterday
+var clockLayouts = []string{
+	"15:04:05",
+	"15:04",
+}
+
+// days are the days relative to now
+var days = map[string]int{
+	"today":     0,
+	"yesterday": -1,
+	"tomorrow":  1,
+}
+
+// LoadLocation returns the timezone of the name, empty or Local is the local timezone of the host
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %s: %v", name, err)
+	}
+	return loc, nil
+}
+
+// Parse parses a time expression relative to now, times without offset are in the timezone of now.
+// Supported expressions:
+//
+//	now, now-2h, now+30m, now-1d    relative to now
+//	2h, 7d                          the duration before now
+//	1700000000, 1700000000.5        unix seconds
+//	today, yesterday 09:00, 09:00   the day relative to now at the time of day
+//	2023-11-06T15:30:00+08:00       RFC3339
+//	2023-11-06 15:30:00, 2023-11-06 local time
+func Parse(s string, now time.Time) (time.Time, error) {
+	expr := strings.TrimSpace(s)
+	lower := strings.ToLower(expr)
+
+	if lower == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(lower, "now") {
+		rest := strings.TrimSpace(lower[len("now"):])
+		if rest == "" || (rest[0] != '-' && rest[0] != '+') {
+			return time.Time{}, parseError(s)
+		}
+		d, err := parseDuration(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return time.Time{}, parseError(s)
+		}
+		if rest[0] == '-' {
+			d = -d
+		}
+		return now.Add(d), nil
+	}
+	if d, err := parseDuration(lower); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, ok := parseUnix(expr, now.Location()); ok {
+		return t, nil
+	}
+	if t, ok := parseDay(lower, now); ok {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, expr); err == nil {
+		return t.In(now.Location()), nil
+	}
+	for _, layout := range localLayouts {
+		if t, err := time.ParseInLocation(layout, expr, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, parseError(s)
+}
+
+func parseError(s string) error {
+	return fmt.Errorf("unable to parse time %q, expected now, now-2h, 2h, yesterday 09:00, unix seconds, RFC3339 or 2006-01-02 15:04:05", s)
+}
+
+// parseDuration parses prometheus durations like 1d12h, and go durations like 1.5h
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseUnix parses unix seconds with an optional fraction
+func parseUnix(s string, loc *time.Location) (time.Time, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || strings.ContainsAny(s, "eExXpP") || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)).In(loc), true
+}
+
+// parseDay parses today, yesterday or tomorrow with an optional time of day, or a time of day of today
+func parseDay(s string, now time.Time) (time.Time, bool) {
+	fields := strings.Fields(s)
+	offset, clock := 0, ""
+	switch len(fields) {
+	case 1:
+		if o, ok := days[fields[0]]; ok {
+			offset = o
+		} else {
+			clock = fields[0]
+		}
+	case 2:
+		o, ok := days[fields[0]]
+		if !ok {
+			return time.Time{}, false
+		}
+		offset, clock = o, fields[1]
+	default:
+		return time.Time{}, false
+	}
+
+	y, m, d := now.Date()
+	day := time.Date(y, m, d+offset, 0, 0, 0, 0, now.Location())
+	if clock == "" {
+		return day, true
+	}
+	for _, layout := range clockLayouts {
+		if c, err := time.Parse(layout, clock); err == nil {
+			return time.Date(day.Year(), day.Month(), day.Day(), c.Hour(), c.Minute(), c.Second(), 0, now.Location()), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,50 @@
+package timeexpr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	loc, err := LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 11, 6, 15, 30, 0, 0, loc)
+	for _, tc := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"now", now},
+		{"now-2h", now.Add(-2 * time.Hour)},
+		{"now + 30m", now.Add(30 * time.Minute)},
+		{"now-1d", now.Add(-24 * time.Hour)},
+		{"2h", now.Add(-2 * time.Hour)},
+		{"7d", now.Add(-7 * 24 * time.Hour)},
+		{"1699255800", time.Date(2023, 11, 6, 15, 30, 0, 0, loc)},
+		{"1699255800.5", time.Date(2023, 11, 6, 15, 30, 0, 5e8, loc)},
+		{"today", time.Date(2023, 11, 6, 0, 0, 0, 0, loc)},
+		{"yesterday 09:00", time.Date(2023, 11, 5, 9, 0, 0, 0, loc)},
+		{"Yesterday 09:00:30", time.Date(2023, 11, 5, 9, 0, 30, 0, loc)},
+		{"09:00", time.Date(2023, 11, 6, 9, 0, 0, 0, loc)},
+		{"2023-11-06T07:30:00Z", time.Date(2023, 11, 6, 15, 30, 0, 0, loc)},
+		{"2023-11-06 15:30:00", now},
+		{"2023-11-06T15:30", now},
+		{"2023-11-06", time.Date(2023, 11, 6, 0, 0, 0, 0, loc)},
+	} {
+		got, err := Parse(tc.expr, now)
+		if err != nil {
+			t.Errorf("Parse(%q) error: %v", tc.expr, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+
+	for _, expr := range []string{"", "now2h", "now-", "yesterday 25:00", "last week", "2023-13-01"} {
+		if got, err := Parse(expr, now); err == nil {
+			t.Errorf("Parse(%q) = %v, want error", expr, got)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package writer
 
 import (
 	"bytes"
+	"fmt"
+	"time"
 
 	"github.com/prometheus/common/model"
 )
@@ -29,14 +31,24 @@ func appendJson(resultbuf *bytes.Buffer, o []byte) error {
 	return nil
 }
 
-func cvsAddTitle(rows *[][]string, name string, expr string) {
+// formatTimestamp renders the timestamp in the timezone, nil is the local timezone
+func formatTimestamp(t model.Time, loc *time.Location, layout string) string {
+	if loc == nil {
+		loc = time.Local
+	}
+	return t.Time().In(loc).Format(layout)
+}
+
+func cvsAddTitle(rows *[][]string, name string, expr string, datasource string) {
 	var titleRow []string
 	titleRow = append(titleRow, "name")
 	titleRow = append(titleRow, "expr")
+	titleRow = append(titleRow, "datasource")
 	*rows = append(*rows, titleRow)
 	var titleValueRow []string
 	titleValueRow = append(titleValueRow, name)
 	titleValueRow = append(titleValueRow, expr)
+	titleValueRow = append(titleValueRow, datasource)
 	*rows = append(*rows, titleValueRow)
 }
 
@@ -50,3 +62,32 @@ func cvsAddHeader(rows *[][]string, labels []model.LabelName) {
 	headerRow = append(headerRow, "timestamp")
 	*rows = append(*rows, headerRow)
 }
+
+// TableWriter extends the Writer interface by adding a Table method
+// Used for writing the results of metadata, series and label values queries
+type TableWriter interface {
+	Writer
+	Defult(noHeaders bool) (bytes.Buffer, error)
+}
+
+// WriteTable writes out the results of the query in the
+// desired output format and prints it to stdout
+func WriteTable(t TableWriter, format string, noHeaders bool) error {
+	var (
+		buf bytes.Buffer
+		err error
+	)
+	switch format {
+	case "json":
+		buf, err = t.Json()
+	case "csv":
+		buf, err = t.Csv(noHeaders)
+	default:
+		buf, err = t.Defult(noHeaders)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(buf.String())
+	return nil
+}
@@ -0,0 +1,88 @@
+// writer provides our stdout writers for promql query results
+package writer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/prometheus/common/model"
+)
+
+// LabelsResult is wrapper of the prometheus label values returned from label values queries
+// Satisfies the TableWriter interface
+type LabelsResult struct {
+	Label  string
+	Values model.LabelValues
+}
+
+// Defult returns the label values as a single column table
+func (r *LabelsResult) Defult(noHeaders bool) (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	const padding = 4
+	w := tabwriter.NewWriter(&buf, 0, 0, padding, ' ', 0)
+	if !noHeaders {
+		if _, err := fmt.Fprintln(w, strings.ToUpper(r.Label)); err != nil {
+			return buf, err
+		}
+	}
+	for _, v := range r.Values {
+		if _, err := fmt.Fprintln(w, string(v)); err != nil {
+			return buf, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+// Json returns the label values as json
+func (r *LabelsResult) Json() (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	o, err := json.Marshal(r.Values)
+	if err != nil {
+		return buf, err
+	}
+	buf.Write(o)
+	return buf, nil
+}
+
+func (r *LabelsResult) AppendJson(resultbuf *bytes.Buffer) error {
+	o, err := json.Marshal(r.Values)
+	if err != nil {
+		return err
+	}
+	return appendJson(resultbuf, o)
+}
+
+// Csv returns the label values as a single column csv
+func (r *LabelsResult) Csv(noHeaders bool) (bytes.Buffer, error) {
+	var (
+		buf  bytes.Buffer
+		rows [][]string
+	)
+	w := csv.NewWriter(&buf)
+	if !noHeaders {
+		rows = append(rows, []string{r.Label})
+	}
+	for _, v := range r.Values {
+		rows = append(rows, []string{string(v)})
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+func (r *LabelsResult) AppendCsv(noHeaders bool, resultbuf *bytes.Buffer) error {
+	res, err := r.Csv(noHeaders)
+	if err != nil {
+		return err
+	}
+	_, err = resultbuf.Write(res.Bytes())
+	return err
+}
@@ -29,6 +29,9 @@ type MatrixWriter interface {
 type MatrixResult struct {
 	common.Rule
 	model.Matrix
+	Datasource string
+	// Location is the timezone of the rendered timestamps, nil is the local timezone
+	Location *time.Location `json:"-"`
 }
 
 // Graph returns an ascii graph using https://github.com/guptarohit/asciigraph
@@ -50,8 +53,8 @@ func (r *MatrixResult) Defult(dim util.TermDimensions) (bytes.Buffer, error) {
 			data = append(data, float64(v.Value))
 		}
 
-		start = m.Values[0].Timestamp.Time().Format(time.Stamp)
-		end = m.Values[(len(m.Values) - 1)].Timestamp.Time().Format(time.Stamp)
+		start = formatTimestamp(m.Values[0].Timestamp, r.Location, time.Stamp)
+		end = formatTimestamp(m.Values[(len(m.Values)-1)].Timestamp, r.Location, time.Stamp)
 
 		timeRange := start + " -> " + end
 
@@ -61,6 +64,7 @@ func (r *MatrixResult) Defult(dim util.TermDimensions) (bytes.Buffer, error) {
 		// Create title for each graph
 		nameHeader := "# Name: " + r.Name
 		exprHeader := "# EXPR: " + r.Expr
+		datasourceHeader := "# DATASOURCE: " + r.Datasource
 		// Create our header for each graph
 		// # TIME_RANGE: Sep 27 09:08:09 -> Sep 27 09:18:09
 		timeRangeHeader := "# TIME_RANGE: " + timeRange
@@ -74,11 +78,12 @@ func (r *MatrixResult) Defult(dim util.TermDimensions) (bytes.Buffer, error) {
 
 		// Determine the longest header string and set the border (######) to it's length + 2
 		// Add spacing to the shortest header
-		maxlenth := math.Max(math.Max(float64(len(metricHeader)), float64(len(metricHeader))), math.Max(float64(len(nameHeader)), float64(len(exprHeader))))
+		maxlenth := math.Max(math.Max(float64(len(metricHeader)), float64(len(datasourceHeader))), math.Max(float64(len(nameHeader)), float64(len(exprHeader))))
 		borderLength = int(maxlenth) + 2
 		metricHeader = metricHeader + strings.Repeat(" ", (int(maxlenth)-len(metricHeader)))
 		nameHeader = nameHeader + strings.Repeat(" ", (int(maxlenth)-len(nameHeader)))
 		exprHeader = exprHeader + strings.Repeat(" ", (int(maxlenth)-len(exprHeader)))
+		datasourceHeader = datasourceHeader + strings.Repeat(" ", (int(maxlenth)-len(datasourceHeader)))
 		timeRangeHeader = timeRangeHeader + strings.Repeat(" ", (int(maxlenth)-len(timeRangeHeader)))
 
 		// Create the border of '#'
@@ -93,6 +98,9 @@ func (r *MatrixResult) Defult(dim util.TermDimensions) (bytes.Buffer, error) {
 		if _, err := fmt.Fprintf(&buf, "%s #\n", exprHeader); err != nil {
 			return buf, err
 		}
+		if _, err := fmt.Fprintf(&buf, "%s #\n", datasourceHeader); err != nil {
+			return buf, err
+		}
 		if _, err := fmt.Fprintf(&buf, "%s #\n", timeRangeHeader); err != nil {
 			return buf, err
 		}
@@ -150,7 +158,7 @@ func (r *MatrixResult) Csv(noHeaders bool) (bytes.Buffer, error) {
 	if err != nil {
 		return buf, err
 	}
-	cvsAddTitle(&rows, r.Name, r.Expr)
+	cvsAddTitle(&rows, r.Name, r.Expr, r.Datasource)
 
 	if !noHeaders {
 		cvsAddHeader(&rows, labels)
@@ -163,7 +171,7 @@ func (r *MatrixResult) Csv(noHeaders bool) (bytes.Buffer, error) {
 				row[i] = string(m.Metric[key])
 			}
 			row = append(row, v.Value.String())
-			row = append(row, v.Timestamp.Time().Format(time.RFC3339))
+			row = append(row, formatTimestamp(v.Timestamp, r.Location, time.RFC3339))
 			rows = append(rows, row)
 		}
 	}
@@ -0,0 +1,116 @@
+// writer provides our stdout writers for promql query results
+package writer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// MetaResult is wrapper of the prometheus metadata returned from metadata queries
+// Satisfies the TableWriter interface
+type MetaResult struct {
+	Meta map[string][]v1.Metadata
+}
+
+// metaRow is a metric name with one of its metadata
+type metaRow struct {
+	Metric string `json:"metric"`
+	Type   string `json:"type"`
+	Help   string `json:"help"`
+	Unit   string `json:"unit"`
+}
+
+// rows returns the metadata sorted by metric name
+func (r *MetaResult) rows() []metaRow {
+	var rows []metaRow
+	for metric, metaList := range r.Meta {
+		for _, m := range metaList {
+			rows = append(rows, metaRow{
+				Metric: metric,
+				Type:   string(m.Type),
+				Help:   m.Help,
+				Unit:   m.Unit,
+			})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Metric < rows[j].Metric
+	})
+	return rows
+}
+
+// Defult returns the metadata as a tab separated table
+func (r *MetaResult) Defult(noHeaders bool) (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	const padding = 4
+	w := tabwriter.NewWriter(&buf, 0, 0, padding, ' ', 0)
+	if !noHeaders {
+		if _, err := fmt.Fprintln(w, "METRIC\tTYPE\tHELP\tUNIT"); err != nil {
+			return buf, err
+		}
+	}
+	for _, row := range r.rows() {
+		data := []string{row.Metric, row.Type, row.Help, row.Unit}
+		if _, err := fmt.Fprintln(w, strings.Join(data, "\t")); err != nil {
+			return buf, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+// Json returns the metadata as json
+func (r *MetaResult) Json() (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	o, err := json.Marshal(r.rows())
+	if err != nil {
+		return buf, err
+	}
+	buf.Write(o)
+	return buf, nil
+}
+
+func (r *MetaResult) AppendJson(resultbuf *bytes.Buffer) error {
+	o, err := json.Marshal(r.rows())
+	if err != nil {
+		return err
+	}
+	return appendJson(resultbuf, o)
+}
+
+// Csv returns the metadata as a csv
+func (r *MetaResult) Csv(noHeaders bool) (bytes.Buffer, error) {
+	var (
+		buf  bytes.Buffer
+		rows [][]string
+	)
+	w := csv.NewWriter(&buf)
+	if !noHeaders {
+		rows = append(rows, []string{"metric", "type", "help", "unit"})
+	}
+	for _, row := range r.rows() {
+		rows = append(rows, []string{row.Metric, row.Type, row.Help, row.Unit})
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+func (r *MetaResult) AppendCsv(noHeaders bool, resultbuf *bytes.Buffer) error {
+	res, err := r.Csv(noHeaders)
+	if err != nil {
+		return err
+	}
+	_, err = resultbuf.Write(res.Bytes())
+	return err
+}
@@ -0,0 +1,122 @@
+// writer provides our stdout writers for promql query results
+package writer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/prometheus/common/model"
+)
+
+// SeriesResult is wrapper of the prometheus label sets returned from series queries
+// Satisfies the TableWriter interface
+type SeriesResult []model.LabelSet
+
+// uniqLabels returns the sorted label names of all series
+func (r SeriesResult) uniqLabels() []model.LabelName {
+	labelKeys := make(map[model.LabelName]struct{})
+	for _, ls := range r {
+		for key := range ls {
+			labelKeys[key] = struct{}{}
+		}
+	}
+	var labels []model.LabelName
+	for key := range labelKeys {
+		labels = append(labels, key)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i] < labels[j]
+	})
+	return labels
+}
+
+// Defult returns the series as a tab separated table, one column per label name
+func (r SeriesResult) Defult(noHeaders bool) (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	const padding = 4
+	w := tabwriter.NewWriter(&buf, 0, 0, padding, ' ', 0)
+	labels := r.uniqLabels()
+	if !noHeaders {
+		var headers []string
+		for _, k := range labels {
+			headers = append(headers, strings.ToUpper(string(k)))
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+			return buf, err
+		}
+	}
+	for _, ls := range r {
+		data := make([]string, len(labels))
+		for i, key := range labels {
+			data[i] = string(ls[key])
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(data, "\t")); err != nil {
+			return buf, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+// Json returns the series as json
+func (r SeriesResult) Json() (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	o, err := json.Marshal(r)
+	if err != nil {
+		return buf, err
+	}
+	buf.Write(o)
+	return buf, nil
+}
+
+func (r SeriesResult) AppendJson(resultbuf *bytes.Buffer) error {
+	o, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return appendJson(resultbuf, o)
+}
+
+// Csv returns the series as a csv, one column per label name
+func (r SeriesResult) Csv(noHeaders bool) (bytes.Buffer, error) {
+	var (
+		buf  bytes.Buffer
+		rows [][]string
+	)
+	w := csv.NewWriter(&buf)
+	labels := r.uniqLabels()
+	if !noHeaders {
+		var headerRow []string
+		for _, k := range labels {
+			headerRow = append(headerRow, string(k))
+		}
+		rows = append(rows, headerRow)
+	}
+	for _, ls := range r {
+		row := make([]string, len(labels))
+		for i, key := range labels {
+			row[i] = string(ls[key])
+		}
+		rows = append(rows, row)
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+func (r SeriesResult) AppendCsv(noHeaders bool, resultbuf *bytes.Buffer) error {
+	res, err := r.Csv(noHeaders)
+	if err != nil {
+		return err
+	}
+	_, err = resultbuf.Write(res.Bytes())
+	return err
+}
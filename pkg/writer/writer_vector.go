@@ -31,6 +31,9 @@ type VectorWriter interface {
 type VectorResult struct {
 	common.Rule
 	model.Vector
+	Datasource string
+	// Location is the timezone of the rendered timestamps, nil is the local timezone
+	Location *time.Location `json:"-"`
 }
 
 // Table returns the response from an vector query as a tab separated table
@@ -45,6 +48,7 @@ func (r *VectorResult) Defult(noHeaders bool) (bytes.Buffer, error) {
 	var titles []string
 	titles = append(titles, "NAME")
 	titles = append(titles, "EXPR")
+	titles = append(titles, "DATASOURCE")
 	titleRow := strings.Join(titles, "\t")
 	if _, err := fmt.Fprintln(w, titleRow); err != nil {
 		return buf, err
@@ -53,6 +57,7 @@ func (r *VectorResult) Defult(noHeaders bool) (bytes.Buffer, error) {
 	var titleValues []string
 	titleValues = append(titleValues, r.Name)
 	titleValues = append(titleValues, r.Expr)
+	titleValues = append(titleValues, r.Datasource)
 	titleValuesRow := strings.Join(titleValues, "\t")
 	if _, err := fmt.Fprintln(w, titleValuesRow); err != nil {
 		return buf, err
@@ -77,7 +82,7 @@ func (r *VectorResult) Defult(noHeaders bool) (bytes.Buffer, error) {
 			data[i] = string(v.Metric[key])
 		}
 		data = append(data, v.Value.String())
-		data = append(data, v.Timestamp.Time().Format(time.RFC3339))
+		data = append(data, formatTimestamp(v.Timestamp, r.Location, time.RFC3339))
 		row := strings.Join(data, "\t")
 		if _, err := fmt.Fprintln(w, row); err != nil {
 			return buf, err
@@ -132,7 +137,7 @@ func (r *VectorResult) Csv(noHeaders bool) (bytes.Buffer, error) {
 		return buf, err
 	}
 
-	cvsAddTitle(&rows, r.Name, r.Expr)
+	cvsAddTitle(&rows, r.Name, r.Expr, r.Datasource)
 
 	if !noHeaders {
 		cvsAddHeader(&rows, labels)
@@ -144,7 +149,7 @@ func (r *VectorResult) Csv(noHeaders bool) (bytes.Buffer, error) {
 			row[i] = string(v.Metric[key])
 		}
 		row = append(row, v.Value.String())
-		row = append(row, v.Timestamp.Time().Format(time.RFC3339))
+		row = append(row, formatTimestamp(v.Timestamp, r.Location, time.RFC3339))
 		rows = append(rows, row)
 	}
 	if err := w.WriteAll(rows); err != nil {
@@ -173,6 +178,9 @@ func getNeedToAddExcelHeader(old, new []model.LabelName) []model.LabelName {
 	if _, exists := oldLabelMap["TIMESTAMP"]; !exists {
 		newLabelsNotInOld = append(newLabelsNotInOld, "TIMESTAMP")
 	}
+	if _, exists := oldLabelMap["DATASOURCE"]; !exists {
+		newLabelsNotInOld = append(newLabelsNotInOld, "DATASOURCE")
+	}
 	if _, exists := oldLabelMap["RULE"]; !exists {
 		newLabelsNotInOld = append(newLabelsNotInOld, "RULE")
 	}
@@ -263,7 +271,11 @@ func (r *VectorResult) Excel(excel common.ExcelFile) error {
 					return err
 				}
 			case "TIMESTAMP":
-				if err = excel.ExcelLize.SetCellValue(sheetName, cellName, metrics.Timestamp.Time().Format(time.RFC3339)); err != nil {
+				if err = excel.ExcelLize.SetCellValue(sheetName, cellName, formatTimestamp(metrics.Timestamp, r.Location, time.RFC3339)); err != nil {
+					return err
+				}
+			case "DATASOURCE":
+				if err = excel.ExcelLize.SetCellValue(sheetName, cellName, r.Datasource); err != nil {
 					return err
 				}
 			}